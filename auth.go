@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/tekisatsu/chirpy/internal/database"
+	"github.com/tekisatsu/chirpy/internal/keyring"
+)
+
+// Why a bearer token was refused. Each becomes a 401 with a
+// WWW-Authenticate challenge saying so.
+var (
+	errTokenMissing     = errors.New("Missing bearer token")
+	errTokenMalformed   = errors.New("Malformed token")
+	errTokenSignature   = errors.New("Invalid token signature")
+	errTokenExpired     = errors.New("Token expired")
+	errTokenNotYetValid = errors.New("Token not valid yet")
+	errTokenWrongType   = errors.New("Wrong token type")
+	errTokenClaims      = errors.New("Invalid token claims")
+	errSessionRevoked   = errors.New("Session logged out")
+	errAdminToken       = errors.New("Invalid admin token")
+)
+
+// tokenKind is a type of JWT Chirpy issues. Each has its own issuer and
+// audience, so a token of one kind is never accepted as another.
+type tokenKind struct {
+	name     string
+	issuer   string
+	audience string
+}
+
+var accessTokenKind = tokenKind{name: "access", issuer: "chirpy-access", audience: "chirpy-api"}
+
+// Scopes are what an access token may be used for. Routes that change
+// something declare the scope they need with requireScope.
+const (
+	scopeRead    = "read"
+	scopeWrite   = "write"
+	scopeAccount = "account"
+)
+
+// loginScopes are the scopes of the access tokens logins and refreshes
+// issue.
+var loginScopes = []string{scopeRead, scopeWrite, scopeAccount}
+
+// accessClaims ties an access token to the session it was issued for.
+// Scope lists what the token may be used for, space separated.
+type accessClaims struct {
+	jwt.RegisteredClaims
+	SessionId string `json:"sid,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+}
+
+// tokenValidator is the one place tokens are checked. It only accepts the
+// algorithms of the keyring's keys, each key only for its own algorithm,
+// and allows leeway for clocks that disagree.
+type tokenValidator struct {
+	keys   *keyring.Ring
+	leeway time.Duration
+}
+
+func bearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(header, " ")
+	if header == "" || !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", errTokenMissing
+	}
+	return strings.TrimSpace(token), nil
+}
+
+// validate checks tokenStr is a valid token of kind. Claims have to be of
+// the type the kind is issued with.
+func (v tokenValidator) validate(tokenStr string, kind tokenKind, claims jwt.Claims) error {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(v.keys.Algs()),
+		jwt.WithIssuer(kind.issuer),
+		jwt.WithAudience(kind.audience),
+		jwt.WithLeeway(v.leeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	_, err := parser.ParseWithClaims(tokenStr, claims, v.keys.Keyfunc)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return fmt.Errorf("%w: %v", errTokenMalformed, err)
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return errTokenExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return errTokenNotYetValid
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer), errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return fmt.Errorf("%w: expected an %s token", errTokenWrongType, kind.name)
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return fmt.Errorf("%w: %v", errTokenSignature, err)
+	default:
+		return fmt.Errorf("%w: %v", errTokenClaims, err)
+	}
+}
+
+// accessToken validates the access token r is authorized with.
+func (cfg *apiConfig) accessToken(r *http.Request) (*accessClaims, error) {
+	tokenStr, err := bearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+	claims := &accessClaims{}
+	if err := cfg.tokens.validate(tokenStr, accessTokenKind, claims); err != nil {
+		return nil, err
+	}
+	if _, err := strconv.Atoi(claims.Subject); err != nil {
+		return nil, fmt.Errorf("%w: subject %q isn't a user id", errTokenClaims, claims.Subject)
+	}
+	return claims, nil
+}
+
+// principal is who a request was authenticated as.
+type principal struct {
+	UserId    int
+	TokenType string
+	Scopes    []string
+	SessionId string
+}
+
+func (p *principal) hasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// authenticate checks the access token r carries and that its session is
+// still logged in.
+func (s *Server) authenticate(r *http.Request) (*principal, error) {
+	claims, err := s.apiConfig.accessToken(r)
+	if err != nil {
+		return nil, err
+	}
+	if claims.SessionId == "" {
+		return nil, fmt.Errorf("%w: no session", errTokenClaims)
+	}
+	session, err := s.DB.GetSession(claims.SessionId)
+	if errors.Is(err, database.ErrSessionNotFound) {
+		return nil, errSessionRevoked
+	}
+	if err != nil {
+		return nil, err
+	}
+	userId, _ := strconv.Atoi(claims.Subject)
+	if session.UserId != userId || session.RevokedAt != nil || !time.Now().Before(session.ExpiresAt) {
+		return nil, errSessionRevoked
+	}
+	scopes := strings.Fields(claims.Scope)
+	if claims.Scope == "" {
+		// Issued before tokens carried scopes, by a login.
+		scopes = loginScopes
+	}
+	return &principal{
+		UserId:    userId,
+		TokenType: accessTokenKind.name,
+		Scopes:    scopes,
+		SessionId: claims.SessionId,
+	}, nil
+}
+
+// requireAuth refuses requests without a valid access token, and puts who
+// made the rest in their context.
+func (s *Server) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := s.authenticate(r)
+		if err != nil {
+			respondAuthError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// requireScope refuses requests whose access token lacks scope with a
+// 403, on routes behind requireAuth.
+func requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			current, ok := currentUser(r)
+			if !ok {
+				w.WriteHeader(500)
+				return
+			}
+			if current.TokenType != accessTokenKind.name || !current.hasScope(scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="chirpy", error="insufficient_scope", scope=%q`, scope))
+				respondWithError(w, 403, fmt.Sprintf("Token lacks the %s scope", scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// optionalAuth puts who made a request in its context when it carries a
+// valid access token, and serves it anonymously otherwise, so a client
+// holding an expired or logged out token can still read public pages.
+func (s *Server) optionalAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := s.authenticate(r)
+		switch {
+		case err == nil:
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+		case tokenErrorReason(err) == nil:
+			log.Printf("Error authenticating, serving anonymously: %v", err)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAdmin refuses requests that don't carry the admin token operators
+// set in ADMIN_TOKEN. With none set, the admin API refuses everything.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := bearerToken(r)
+		if err != nil {
+			respondAuthError(w, err)
+			return
+		}
+		adminToken := s.apiConfig.adminToken
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			respondAuthError(w, errAdminToken)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// principalFrom is who ctx was authenticated as, if anyone.
+func principalFrom(ctx context.Context) (*principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*principal)
+	return p, ok
+}
+
+// currentUser is who made r, on routes behind requireAuth. It only
+// reports false for a route mounted without it, which handlers answer
+// with a 500.
+func currentUser(r *http.Request) (*principal, bool) {
+	p, ok := principalFrom(r.Context())
+	if !ok {
+		log.Printf("No authenticated user for %s %s, is the route behind requireAuth?", r.Method, r.URL.Path)
+	}
+	return p, ok
+}
+
+var tokenErrors = []error{
+	errTokenMissing, errTokenMalformed, errTokenSignature, errTokenExpired, errTokenNotYetValid,
+	errTokenWrongType, errTokenClaims, errSessionRevoked, errAdminToken, database.ErrInvalidRefreshToken,
+}
+
+// tokenErrorReason is which of the reasons a token is refused err is, or
+// nil when it is some other failure.
+func tokenErrorReason(err error) error {
+	for _, reason := range tokenErrors {
+		if errors.Is(err, reason) {
+			return reason
+		}
+	}
+	return nil
+}
+
+// respondAuthError refuses a request whose token failed validation with a
+// 401, challenging the client as RFC 6750 describes. Any other error
+// authenticating it is a 500.
+func respondAuthError(w http.ResponseWriter, err error) {
+	reason := tokenErrorReason(err)
+	if reason == nil {
+		log.Printf("Error authenticating: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	log.Printf("Invalid token: %v", err)
+	challenge := `Bearer realm="chirpy"`
+	if reason != errTokenMissing {
+		challenge += fmt.Sprintf(`, error="invalid_token", error_description=%q`, reason.Error())
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	respondWithError(w, 401, reason.Error())
+}
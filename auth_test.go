@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestTokenValidation(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	keys := ts.server.apiConfig.keys
+	leeway := ts.server.apiConfig.tokens.leeway
+	kid := keys.JWKS().Keys[0].Kid
+	now := time.Now()
+
+	claims := func(change func(c *accessClaims)) *accessClaims {
+		c := &accessClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   "1",
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+				Issuer:    accessTokenKind.issuer,
+				Audience:  jwt.ClaimStrings{accessTokenKind.audience},
+			},
+			SessionId: "session",
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	signed := func(c *accessClaims) string {
+		token, err := keys.Sign(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	// unsigned forges a token with method instead of the keyring's key.
+	unsigned := func(method jwt.SigningMethod, key any) string {
+		token := jwt.NewWithClaims(method, claims(nil))
+		token.Header["kid"] = kid
+		str, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return str
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid", signed(claims(nil)), nil},
+		{"HS256 with the key id", unsigned(jwt.SigningMethodHS256, []byte("secret")), errTokenSignature},
+		{"alg none", unsigned(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType), errTokenSignature},
+		{"garbled", "not-a-token", errTokenMalformed},
+		{"wrong issuer", signed(claims(func(c *accessClaims) { c.Issuer = "chirpy-refresh" })), errTokenWrongType},
+		{"wrong audience", signed(claims(func(c *accessClaims) { c.Audience = jwt.ClaimStrings{"elsewhere"} })), errTokenWrongType},
+		{"expired", signed(claims(func(c *accessClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(now.Add(-leeway - time.Minute))
+		})), errTokenExpired},
+		{"expired within the leeway", signed(claims(func(c *accessClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(now.Add(-leeway / 2))
+		})), nil},
+		{"issued in the future", signed(claims(func(c *accessClaims) {
+			c.IssuedAt = jwt.NewNumericDate(now.Add(leeway + time.Minute))
+		})), errTokenNotYetValid},
+		{"issued in the future within the leeway", signed(claims(func(c *accessClaims) {
+			c.IssuedAt = jwt.NewNumericDate(now.Add(leeway / 2))
+		})), nil},
+		{"no expiry", signed(claims(func(c *accessClaims) { c.ExpiresAt = nil })), errTokenClaims},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ts.server.apiConfig.tokens.validate(tt.token, accessTokenKind, &accessClaims{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("validate = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil {
+				return
+			}
+			rec := ts.do("GET", "/api/timeline", tt.token, nil)
+			ts.expect(rec, 401, nil)
+			want := fmt.Sprintf(`Bearer realm="chirpy", error="invalid_token", error_description=%q`, tt.wantErr.Error())
+			if got := rec.Header().Get("WWW-Authenticate"); got != want {
+				t.Errorf("challenge = %s, want %s", got, want)
+			}
+		})
+	}
+}
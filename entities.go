@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tekisatsu/chirpy/internal/database"
+)
+
+// getHashtag pages through chirps tagged with a hashtag, newest first
+// unless sort says otherwise. Tags match whatever their case.
+func (s *Server) getHashtag(w http.ResponseWriter, r *http.Request) {
+	q, err := parseChirpQuery(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if r.URL.Query().Get("sort") == "" {
+		q.Desc = true
+	}
+	q.Hashtag = database.HashtagKey(chi.URLParam(r, "tag"))
+	if q.Hashtag == "" {
+		respondWithError(w, 400, "Invalid hashtag")
+		return
+	}
+	page, err := s.pageChirps(r, q)
+	if err != nil {
+		log.Printf("Error getting hashtag: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	respondWithJSON(w, 200, page)
+}
+
+// getMentions pages through chirps that mention a user, newest first
+// unless sort says otherwise.
+func (s *Server) getMentions(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid user id")
+		return
+	}
+	q, err := parseChirpQuery(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if r.URL.Query().Get("sort") == "" {
+		q.Desc = true
+	}
+	if _, err := s.DB.GetUser(userId); err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		log.Printf("Error getting user: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	q.MentionOf = userId
+	page, err := s.pageChirps(r, q)
+	if err != nil {
+		log.Printf("Error getting mentions: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	respondWithJSON(w, 200, page)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tekisatsu/chirpy/internal/database"
+)
+
+func (s *Server) followUser(w http.ResponseWriter, r *http.Request) {
+	s.changeFollow(w, r, s.DB.FollowUser)
+}
+func (s *Server) unfollowUser(w http.ResponseWriter, r *http.Request) {
+	s.changeFollow(w, r, s.DB.UnfollowUser)
+}
+func (s *Server) changeFollow(w http.ResponseWriter, r *http.Request, change func(followerId, followeeId int) error) {
+	current, ok := currentUser(r)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+	userId := current.UserId
+	targetId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid user id")
+		return
+	}
+	err = change(userId, targetId)
+	switch {
+	case errors.Is(err, database.ErrFollowSelf):
+		respondWithError(w, 400, err.Error())
+		return
+	case errors.Is(err, database.ErrUserNotFound):
+		w.WriteHeader(404)
+		return
+	case err != nil:
+		log.Printf("Error changing follow: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+func (s *Server) getFollowers(w http.ResponseWriter, r *http.Request) {
+	s.listFollows(w, r, s.DB.GetFollowers)
+}
+func (s *Server) getFollowing(w http.ResponseWriter, r *http.Request) {
+	s.listFollows(w, r, s.DB.GetFollowing)
+}
+func (s *Server) listFollows(w http.ResponseWriter, r *http.Request, list func(userId int) ([]database.Follow, error)) {
+	userId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid user id")
+		return
+	}
+	follows, err := list(userId)
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Printf("Error listing follows: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	respondWithJSON(w, 200, follows)
+}
+
+// getTimeline pages through chirps by the accounts the caller follows,
+// newest first unless sort says otherwise.
+func (s *Server) getTimeline(w http.ResponseWriter, r *http.Request) {
+	current, ok := currentUser(r)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+	userId := current.UserId
+	q, err := parseChirpQuery(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if r.URL.Query().Get("sort") == "" {
+		q.Desc = true
+	}
+	q.FollowedBy = userId
+	page, err := s.pageChirps(r, q)
+	if err != nil {
+		log.Printf("Error getting timeline: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	respondWithJSON(w, 200, page)
+}
@@ -3,8 +3,9 @@ package database
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"os"
-	"sort"
 	"sync"
 	"time"
 
@@ -12,279 +13,520 @@ import (
 )
 
 type DB struct {
-	path string
-	mux *sync.RWMutex
+	path       string
+	mux        *sync.RWMutex
+	data       DBSuper
+	wal        *os.File
+	walSize    int64
+	walEntries int
+	compactCh  chan struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
 }
 type DBSuper struct {
-	DBStructure DBStructure
-	UserInternal []UserInternal
-	RevokedTokens map[string]time.Time
+	Version       int
+	Seq           int64
+	DBStructure   DBStructure
+	UserInternal  []UserInternal
+	Follows       map[int]map[int]time.Time
+	Likes         map[int]map[int]time.Time
+	RefreshTokens map[string]RefreshToken
+	Sessions      map[string]Session
+	Flags         []Flag
+	chirpOrder    []int
+	authored      map[int][]int
+	search        *searchIndex
+	followers     map[int]map[int]time.Time
+	conversations map[int][]int
+	liked         map[int]map[int]time.Time
+	rechirps      map[int][]int
+	quotes        map[int][]int
+	hashtags      map[string][]int
+	mentions      map[int][]int
+	families      map[string][]string
 }
 type DBStructure struct {
-	Chirps map[int]Chirp `json:"chirps"`
-	User UserResponse
-	UserAmount int `json:"usreamount"`
+	Chirps      map[int]Chirp           `json:"chirps"`
+	Revisions   map[int][]ChirpRevision `json:"revisions"`
+	ChirpAmount int                     `json:"chirp_amount"`
+	UserAmount  int                     `json:"user_amount"`
 }
 type Chirp struct {
-	Id int `json:"id"`
-	Body string `json:"body"`
-	AuthorId int `json:"author_id"`
+	Id             int        `json:"id"`
+	Body           string     `json:"body"`
+	AuthorId       int        `json:"author_id"`
+	InReplyTo      *int       `json:"in_reply_to,omitempty"`
+	RechirpOf      *int       `json:"rechirp_of,omitempty"`
+	QuoteOf        *int       `json:"quote_of,omitempty"`
+	ConversationId int        `json:"conversation_id"`
+	Entities       Entities   `json:"entities"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	DeletedAt      *time.Time `json:"deleted_at,omitempty"`
+}
+type ChirpRevision struct {
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
 }
 type UserResponse struct {
-	Id int `json:"id"`
-	Email string `json:"email"`
+	Id          int    `json:"id"`
+	Email       string `json:"email"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	AvatarURL   string `json:"avatar_url"`
 }
 type UserInternal struct {
-	Id int `json:"id"`
-	Email string `json:"email"`
-	Password []byte `json:"password"`
+	Id          int    `json:"id"`
+	Email       string `json:"email"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	Password    []byte `json:"password"`
 }
-func (db *DB) RefreshToken(tokenStr string) error {
+
+func (db *DB) IssueRefreshToken(userId int, ttl time.Duration, client Client) (IssuedToken, error) {
 	db.mux.Lock()
 	defer db.mux.Unlock()
-	dbSuper,err := db.loadDb()
+	entry, issued, err := db.data.issueRefreshToken(userId, ttl, client)
+	if err != nil {
+		return IssuedToken{}, err
+	}
+	return issued, db.commit(entry)
+}
+func (db *DB) RotateRefreshToken(token string, ttl time.Duration, client Client) (IssuedToken, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entries, issued, err := db.data.rotateRefreshToken(token, ttl, client)
+	if len(entries) > 0 {
+		if errW := db.commit(entries...); errW != nil {
+			return IssuedToken{}, errW
+		}
+	}
+	return issued, err
+}
+func (db *DB) RevokeRefreshToken(token string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.revokeRefreshToken(token)
 	if err != nil {
 		return err
 	}
-	if _,ok := dbSuper.RevokedTokens[tokenStr];ok {
-		return errors.New("Revoked token")
+	return db.commit(entry)
+}
+func (db *DB) PurgeRefreshTokens(before time.Time) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entries := db.data.purgeRefreshTokens(before)
+	if len(entries) == 0 {
+		return 0, nil
 	}
-	return nil
+	return len(entries), db.commit(entries...)
+}
+func (db *DB) ListSessions(userId int) ([]Session, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.listSessions(userId), nil
+}
+func (db *DB) GetSession(id string) (Session, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getSession(id)
 }
-func (db *DB) RevokeRefreshToken (tokenStr string)error{
+func (db *DB) RevokeSession(userId int, id string) error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
-	dbSuper,err := db.loadDb()
+	entry, err := db.data.revokeSession(userId, id)
 	if err != nil {
 		return err
 	}
-	dbSuper.RevokedTokens[tokenStr]=time.Now().UTC()
-	dat,err := json.Marshal(dbSuper)
+	return db.commit(entry)
+}
+func (db *DB) RevokeOtherSessions(userId int, keep string) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entries := db.data.revokeOtherSessions(userId, keep)
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	return len(entries), db.commit(entries...)
+}
+func (db *DB) FlagChirp(chirpId int, flags []Flag) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.flagChirp(chirpId, flags)
 	if err != nil {
 		return err
 	}
-	os.WriteFile(db.path,dat,0600)
-	return nil
+	return db.commit(entry)
+}
+func (db *DB) GetFlags(limit int) ([]Flag, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getFlags(limit), nil
 }
-func (db *DB) createUserPassword (pword string)([]byte,error) {
-	hash,err := bcrypt.GenerateFromPassword([]byte(pword),14)
+func createUserPassword(pword string) ([]byte, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pword), 14)
 	if err != nil {
-		return nil,err
+		return nil, err
 	}
-	return hash,nil
+	return hash, nil
 }
-func (db *DB)CreateUser(email,password string)(UserResponse,error){
+func (db *DB) CreateUser(email, password, handle string) (UserResponse, error) {
+	hash, err := createUserPassword(password)
+	if err != nil {
+		return UserResponse{}, err
+	}
 	db.mux.Lock()
 	defer db.mux.Unlock()
-	dbSuper,err := db.loadDb()
+	entry, err := db.data.createUser(email, hash, handle)
 	if err != nil {
-		return UserResponse{},err
+		return UserResponse{}, err
 	}
-	for _,user := range dbSuper.UserInternal {
-		if user.Email == email {
-			return UserResponse{},errors.New("Email already in use")
+	errW := db.commit(entry)
+	if errW != nil {
+		return UserResponse{}, errW
+	}
+	return userResponse(entry.User), nil
+}
+func (db *DB) GetUser(id int) (UserResponse, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getUser(id)
+}
+func (db *DB) GetUserByHandle(handle string) (UserResponse, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getUserByHandle(handle)
+}
+func (db *DB) GetProfile(id int) (Profile, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getProfile(id)
+}
+func (db *DB) UserLogin(email, password string) (UserResponse, error) {
+	db.mux.RLock()
+	user, ok := db.data.userByEmail(email)
+	db.mux.RUnlock()
+	return checkLogin(user, ok, password)
+}
+func (db *DB) UpdateUser(id int, update UserUpdate) (UserResponse, error) {
+	if update.Password != nil {
+		db.mux.RLock()
+		hash, err := db.data.passwordHash(id)
+		db.mux.RUnlock()
+		if err != nil {
+			return UserResponse{}, err
+		}
+		if err := update.hashPassword(hash); err != nil {
+			return UserResponse{}, err
 		}
 	}
-	maxId:= dbSuper.DBStructure.UserAmount+1
-	dbSuper.DBStructure.UserAmount = maxId
-	pWord,errP := db.createUserPassword(password)
-	if errP != nil {
-		return UserResponse{},errP
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.updateUser(id, update)
+	if err != nil {
+		return UserResponse{}, err
 	}
-	newUser := UserResponse{
-		Email: email,
-		Id: maxId,
+	errW := db.commit(entry)
+	if errW != nil {
+		return UserResponse{}, errW
+	}
+	return userResponse(entry.User), nil
+}
+func (db *DB) CreateChirp(body string, authorId, inReplyTo, quoteOf int) (Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.createChirp(body, authorId, inReplyTo, quoteOf)
+	if err != nil {
+		return Chirp{}, err
 	}
-	newInternalUser := UserInternal{
-		Email: email,
-		Id: maxId,
-		Password: pWord,
+	errW := db.commit(entry)
+	if errW != nil {
+		return Chirp{}, errW
 	}
-	dbSuper.UserInternal = append(dbSuper.UserInternal, newInternalUser)
-	dat,errM := json.Marshal(dbSuper)
+	return *entry.Chirp, nil
+}
+func (db *DB) loadDb() (DBSuper, error) {
+	dbSuper, err := loadSnapshot(db.path, db.walPath())
+	if err == nil {
+		return dbSuper, nil
+	}
+	bak := backupPath(db.path)
+	if !fileExists(bak) {
+		return DBSuper{}, err
+	}
+	log.Printf("Database file %s is unreadable (%v), recovering from backup %s", db.path, err, bak)
+	dbSuper, errB := loadSnapshot(bak, backupPath(db.walPath()), db.walPath())
+	if errB != nil {
+		return DBSuper{}, fmt.Errorf("Database file %s is unreadable (%v) and so is its backup: %w", db.path, err, errB)
+	}
+	if fileExists(db.path) {
+		corrupt := db.path + ".corrupt"
+		if errR := os.Rename(db.path, corrupt); errR != nil {
+			return DBSuper{}, errR
+		}
+		log.Printf("Moved unreadable database file to %s", corrupt)
+	}
+	return dbSuper, nil
+}
+func loadSnapshot(path string, logs ...string) (DBSuper, error) {
+	dbSuper := DBSuper{}
+	data, errR := os.ReadFile(path)
+	if errR != nil {
+		return DBSuper{}, errR
+	}
+	data, errM := migrateSnapshot(path, data)
 	if errM != nil {
-		return UserResponse{},errM
+		return DBSuper{}, errM
 	}
-	errW := os.WriteFile(db.path,dat,0600)
-	if errW != nil {
-		return UserResponse{},errW
+	errU := json.Unmarshal(data, &dbSuper)
+	if errU != nil {
+		return DBSuper{}, errU
+	}
+	dbSuper.reindex()
+	for _, walPath := range logs {
+		errL := replayLog(walPath, &dbSuper)
+		if errL != nil {
+			return DBSuper{}, errL
+		}
 	}
-	return newUser,nil
+	return dbSuper, nil
+}
+func (db *DB) GetChirps(q ChirpQuery) ([]Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.queryChirps(q), nil
 }
-func (db *DB) UserLogin (email,password string) (UserResponse,error) {
+func (db *DB) GetChirp(id int) (Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getChirp(id)
+}
+func (db *DB) UpdateChirp(id, authorId int, body string) (Chirp, error) {
 	db.mux.Lock()
 	defer db.mux.Unlock()
-	dbSuper,err := db.loadDb()
+	entry, err := db.data.updateChirp(id, authorId, body)
 	if err != nil {
-		return UserResponse{},err
+		return Chirp{}, err
 	}
-	for _,user := range dbSuper.UserInternal {
-		if user.Email == email {
-			err := bcrypt.CompareHashAndPassword(user.Password, []byte(password))
-			if err != nil {
-				return UserResponse{},errors.New("Invalid information")
-			} else {
-				return struct{
-					Id int `json:"id"`
-					Email string `json:"email"`
-				}{Id:user.Id, Email: user.Email},nil
-			}
-		}	
+	errW := db.commit(entry)
+	if errW != nil {
+		return Chirp{}, errW
 	}
-	return UserResponse{},errors.New("Invalid information")
-} 
-func (db *DB)UpdateUser(email,password string, id int)(UserResponse,error){
+	return *entry.Chirp, nil
+}
+func (db *DB) GetChirpHistory(id int) ([]ChirpRevision, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getChirpHistory(id)
+}
+func (db *DB) GetThread(id int) (Thread, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getThread(id)
+}
+func (db *DB) SearchChirps(q SearchQuery) ([]Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.searchChirps(q)
+}
+func (db *DB) DeleteChirp(id, author_id int) error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
-	dbSuper,err := db.loadDb()
+	entry, err := db.data.deleteChirp(id, author_id)
 	if err != nil {
-		return UserResponse{}, err
-	}
-	var updatedUser UserResponse
-	for i,user := range dbSuper.UserInternal {
-		if user.Id==id {
-			newPw,err := db.createUserPassword(password)
-			if err != nil {
-				return UserResponse{}, nil
-			}
-			dbSuper.UserInternal[i].Email = email
-			dbSuper.UserInternal[i].Password = newPw
-			updatedUser = UserResponse{
-				Id: user.Id,
-				Email: email,
-			}
-		}
+		return err
 	}
-	dat,err := json.Marshal(dbSuper)
+	return db.commit(entry)
+}
+func (db *DB) RestoreChirp(id, authorId int, window time.Duration) (Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.restoreChirp(id, authorId, window)
 	if err != nil {
-		return UserResponse{},err
+		return Chirp{}, err
 	}
-	errW := os.WriteFile(db.path,dat,0600)
+	errW := db.commit(entry)
 	if errW != nil {
-		return UserResponse{}, errW
+		return Chirp{}, errW
 	}
-	return updatedUser,nil
+	return db.data.DBStructure.Chirps[id], nil
 }
-func (db *DB)CreateChirp(body string,authorId int)(Chirp,error){
+func (db *DB) PurgeChirps(before time.Time) (int, error) {
 	db.mux.Lock()
 	defer db.mux.Unlock()
-	dbSuper,err := db.loadDb()
-	if err != nil {
-		return Chirp{},err
+	entries := db.data.purgeChirps(before)
+	if len(entries) == 0 {
+		return 0, nil
 	}
-	var maxId int
-	for id := range dbSuper.DBStructure.Chirps{
-		if id > maxId {
-			maxId=id
-		}
+	return len(entries), db.commit(entries...)
+}
+func (db *DB) FollowUser(followerId, followeeId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.followUser(followerId, followeeId)
+	if err != nil {
+		return err
 	}
-	maxId++
-	newChirp := Chirp{
-		Id: maxId,
-		Body: body,
-		AuthorId: authorId,
+	if db.data.isFollowing(followerId, followeeId) {
+		return nil
 	}
-	dbSuper.DBStructure.Chirps[newChirp.Id]=newChirp
-	dat,errM := json.Marshal(dbSuper)
-	if errM != nil {
-		return Chirp{},errM
+	return db.commit(entry)
+}
+func (db *DB) UnfollowUser(followerId, followeeId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.unfollowUser(followerId, followeeId)
+	if err != nil {
+		return err
 	}
-	errW:=os.WriteFile(db.path,dat,0600)
-	if errW != nil {
-		return Chirp{},errW
+	if !db.data.isFollowing(followerId, followeeId) {
+		return nil
 	}
-	return newChirp,nil
+	return db.commit(entry)
 }
-func (db *DB)loadDb()(DBSuper,error){
-	dbSuper := DBSuper{}
-	data,errR := os.ReadFile(db.path)
-	if errR != nil {
-		return DBSuper{},errR
+func (db *DB) GetFollowers(userId int) ([]Follow, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getFollowers(userId)
+}
+func (db *DB) GetFollowing(userId int) ([]Follow, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getFollowing(userId)
+}
+func (db *DB) LikeChirp(chirpId, userId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.likeChirp(chirpId, userId)
+	if err != nil {
+		return err
 	}
-	errU := json.Unmarshal(data,&dbSuper)
-	if errU != nil {
-		return DBSuper{},errU
+	if db.data.isLiked(chirpId, userId) {
+		return nil
 	}
-	return dbSuper,nil
+	return db.commit(entry)
 }
-func (db *DB) GetChirps () ([]Chirp,error) {
+func (db *DB) UnlikeChirp(chirpId, userId int) error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
-	dbstructure,err:=db.loadDb()
+	entry, err := db.data.unlikeChirp(chirpId, userId)
 	if err != nil {
-		return nil,err
+		return err
 	}
-	chirps := make([]Chirp ,len(dbstructure.DBStructure.Chirps))
-	i := 0
-	for _,chirp:= range dbstructure.DBStructure.Chirps {
-		chirps[i] = chirp
-		i++
+	if !db.data.isLiked(chirpId, userId) {
+		return nil
 	}
-	sort.SliceStable(chirps,func(i, j int) bool {
-		return chirps[i].Id < chirps[j].Id
-	})
-	return chirps,nil
+	return db.commit(entry)
 }
-func (db *DB) GetChirp (id int) (Chirp,error) {
+func (db *DB) Rechirp(id, authorId int) (Chirp, error) {
 	db.mux.Lock()
 	defer db.mux.Unlock()
-	dbSuper,err := db.loadDb()
+	entry, err := db.data.rechirp(id, authorId)
 	if err != nil {
-		return Chirp{},err
+		return Chirp{}, err
 	}
-	if val,ok := dbSuper.DBStructure.Chirps[id];ok {
-		return val,nil
+	errW := db.commit(entry)
+	if errW != nil {
+		return Chirp{}, errW
 	}
-	return Chirp{},errors.New("Chirp not found")
+	return *entry.Chirp, nil
 }
-func (db DB) DeleteChirp (id,author_id int) error{
+func (db *DB) Unrechirp(id, authorId int) error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
-	dbSuper,err := db.loadDb()
-	e := false
+	entry, err := db.data.unrechirp(id, authorId)
+	if errors.Is(err, errNotRechirped) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	if _,ok := dbSuper.DBStructure.Chirps[id];ok {
-		e = true
-	}
-	if e == true {
-		val := dbSuper.DBStructure.Chirps[id]
-		if val.AuthorId != author_id {
-			return errors.New("Id mismatch")
-		}
-		delete(dbSuper.DBStructure.Chirps,id)
-		if _,ok := dbSuper.DBStructure.Chirps[id];ok{
-			return errors.New("Deleting errors")
-		}
-		return nil
+	return db.commit(entry)
+}
+func (db *DB) ChirpStats(ids []int, userId int) (map[int]ChirpStats, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.chirpStats(ids, userId), nil
+}
+func (db *DB) GetLikedChirps(userId int) ([]Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getLikedChirps(userId)
+}
 
+// Close writes a last snapshot and closes the log. Closing again does
+// nothing.
+func (db *DB) Close() error {
+	var err error
+	db.closeOnce.Do(func() {
+		err = db.close()
+	})
+	return err
+}
+func (db *DB) close() error {
+	close(db.done)
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if db.walEntries > 0 {
+		if err := db.compact(); err != nil {
+			return err
+		}
 	}
-	return errors.New("No Chirp found")
+	return db.wal.Close()
+}
+func newDBSuper() DBSuper {
+	dbSuper := DBSuper{
+		Version: schemaVersion,
+		DBStructure: DBStructure{
+			Chirps:    map[int]Chirp{},
+			Revisions: map[int][]ChirpRevision{},
+		}, Follows: map[int]map[int]time.Time{},
+		Likes:         map[int]map[int]time.Time{},
+		RefreshTokens: map[string]RefreshToken{},
+		Sessions:      map[string]Session{},
+		Flags:         []Flag{},
+	}
+	dbSuper.reindex()
+	return dbSuper
 }
 func NewDb(path string) (*DB, error) {
 	_, err := os.Stat(path)
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			initialData :=&DBSuper{ 
-				DBStructure: DBStructure{
-					Chirps: map[int]Chirp{},
-			},RevokedTokens: make(map[string]time.Time),
-			}
+		if errors.Is(err, os.ErrNotExist) && !fileExists(backupPath(path)) {
+			initialData := newDBSuper()
 			data, err := json.Marshal(initialData)
 			if err != nil {
 				return nil, err
 			}
-			err = os.WriteFile(path, data, 0600)
+			err = writeFileAtomic(path, data)
 			if err != nil {
 				return nil, err
 			}
-		} else {
+		} else if !errors.Is(err, os.ErrNotExist) {
 			return nil, err
 		}
 	}
-	return &DB{
-		path: path,
-		mux:  &sync.RWMutex{},
-	}, nil
+	db := &DB{
+		path:      path,
+		mux:       &sync.RWMutex{},
+		compactCh: make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	if err := db.openLog(); err != nil {
+		return nil, err
+	}
+	db.data, err = db.loadDb()
+	if err != nil {
+		db.wal.Close()
+		return nil, err
+	}
+	if err := db.compact(); err != nil {
+		db.wal.Close()
+		return nil, err
+	}
+	go db.compactLoop()
+	return db, nil
 }
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCloseTwice(t *testing.T) {
+	db := openTestDb(t, filepath.Join(t.TempDir(), "database.json"))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("second Close = %v, want nil", err)
+	}
+}
+
+func TestUserLogin(t *testing.T) {
+	db := openTestDb(t, filepath.Join(t.TempDir(), "database.json"))
+	defer db.Close()
+	user, err := db.CreateUser("alice@example.com", "hunter22", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		wantErr  bool
+	}{
+		{"right password", "alice@example.com", "hunter22", false},
+		{"wrong password", "alice@example.com", "hunter23", true},
+		{"unknown email", "bob@example.com", "hunter22", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.UserLogin(tt.email, tt.password)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("login succeeded as %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil || got.Id != user.Id {
+				t.Errorf("login = %+v, %v, want user %d", got, err, user.Id)
+			}
+		})
+	}
+}
+
+func TestUpdatePassword(t *testing.T) {
+	openStores(t, allStores, func(t *testing.T, db Store) {
+		for _, tt := range []struct {
+			name            string
+			current, newPwd string
+			wantErr         error
+		}{
+			{"wrong current password", "hunter23", "swordfish", ErrWrongPassword},
+			{"empty new password", "hunter22", "", ErrInvalidPassword},
+			{"right current password", "hunter22", "swordfish", nil},
+		} {
+			update := UserUpdate{Password: &tt.newPwd, CurrentPassword: tt.current}
+			if _, err := db.UpdateUser(1, update); !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: update = %v, want %v", tt.name, err, tt.wantErr)
+			}
+		}
+		if _, err := db.UserLogin("alice@example.com", "swordfish"); err != nil {
+			t.Errorf("login with the new password: %v", err)
+		}
+	})
+}
+
+// TestReadsDuringSignup checks bcrypt runs outside the lock, so reads
+// aren't held up by a signup.
+func TestReadsDuringSignup(t *testing.T) {
+	db := openTestDb(t, filepath.Join(t.TempDir(), "database.json"))
+	defer db.Close()
+	createChirps(t, db, "hello")
+	done := make(chan error)
+	go func() {
+		_, err := db.CreateUser("bob@example.com", "hunter22", "bob")
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if _, err := db.GetChirp(1); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("reading a chirp during a signup took %v", elapsed)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,256 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrInvalidHandle = errors.New("Handles are 1 to 15 letters, digits or underscores, and not all digits")
+	ErrHandleTaken   = errors.New("Handle already taken")
+)
+
+const maxHandleLength = 15
+
+// Entities are the hashtags and mentions in a chirp body. Start and End
+// count Unicode code points, End being exclusive, and cover the # or @.
+type Entities struct {
+	Hashtags []Hashtag `json:"hashtags,omitempty"`
+	Mentions []Mention `json:"mentions,omitempty"`
+}
+type Hashtag struct {
+	Tag   string `json:"tag"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+type Mention struct {
+	Handle string `json:"handle"`
+	UserId int    `json:"user_id"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+}
+
+// parseEntities finds the #tags and @handles in body. A sigil only starts
+// an entity at the beginning of a word, so neither "a@b.com" nor "c#" has
+// one. A hashtag needs at least one letter, and a mention is only kept
+// when resolve finds the user, reporting ErrUserNotFound otherwise.
+func parseEntities(body string, resolve func(handle string) (int, error)) (Entities, error) {
+	var entities Entities
+	runes := []rune(body)
+	for i := 0; i < len(runes); i++ {
+		sigil := runes[i]
+		if sigil != '#' && sigil != '@' || i > 0 && isTagRune(runes[i-1]) {
+			continue
+		}
+		j := i + 1
+		for j < len(runes) && (sigil == '#' && isTagRune(runes[j]) || sigil == '@' && isHandleRune(runes[j])) {
+			j++
+		}
+		name := string(runes[i+1 : j])
+		switch {
+		case sigil == '#' && strings.IndexFunc(name, unicode.IsLetter) >= 0:
+			entities.Hashtags = append(entities.Hashtags, Hashtag{Tag: name, Start: i, End: j})
+		case sigil == '@' && validHandle(name) && (j == len(runes) || !isTagRune(runes[j])):
+			id, err := resolve(name)
+			if errors.Is(err, ErrUserNotFound) {
+				break
+			}
+			if err != nil {
+				return Entities{}, err
+			}
+			entities.Mentions = append(entities.Mentions, Mention{Handle: name, UserId: id, Start: i, End: j})
+		}
+		if j > i+1 {
+			i = j - 1
+		}
+	}
+	return entities, nil
+}
+func isTagRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+}
+func isHandleRune(r rune) bool {
+	return r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9'
+}
+
+// validHandle also refuses handles that are all digits, as those would be
+// read as user ids where a profile can be looked up by either.
+func validHandle(handle string) bool {
+	if len(handle) == 0 || len(handle) > maxHandleLength || allDigits(handle) {
+		return false
+	}
+	for _, r := range handle {
+		if !isHandleRune(r) {
+			return false
+		}
+	}
+	return true
+}
+func allDigits(s string) bool {
+	return strings.TrimLeft(s, "0123456789") == ""
+}
+
+// HashtagKey is how a tag is indexed: tags match whatever their case.
+func HashtagKey(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(tag, "#"))
+}
+
+// tags and mentioned list the distinct index keys of the entities.
+func (e Entities) tags() []string {
+	var keys []string
+	for _, tag := range e.Hashtags {
+		key := HashtagKey(tag.Tag)
+		if !containsString(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+func (e Entities) mentioned() []int {
+	var ids []int
+	for _, mention := range e.Mentions {
+		if !containsInt(ids, mention.UserId) {
+			ids = append(ids, mention.UserId)
+		}
+	}
+	return ids
+}
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+func containsInt(list []int, n int) bool {
+	for _, item := range list {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
+
+// handleFromEmail picks a handle for a user who didn't choose one: the
+// handle characters of their email's local part, numbered until taken
+// reports the handle free.
+func handleFromEmail(email string, taken func(handle string) (bool, error)) (string, error) {
+	local, _, _ := strings.Cut(email, "@")
+	return freeHandle(local, taken)
+}
+
+// freeHandle makes a valid handle out of name and numbers it until taken
+// reports it free. A name of only digits is prefixed with "user".
+func freeHandle(name string, taken func(handle string) (bool, error)) (string, error) {
+	base := strings.Map(func(r rune) rune {
+		if isHandleRune(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+	if allDigits(base) {
+		base = "user" + base
+	}
+	if len(base) > maxHandleLength {
+		base = base[:maxHandleLength]
+	}
+	handle := base
+	for n := 2; ; n++ {
+		inUse, err := taken(handle)
+		if err != nil || !inUse {
+			return handle, err
+		}
+		suffix := strconv.Itoa(n)
+		handle = base[:min(len(base), maxHandleLength-len(suffix))] + suffix
+	}
+}
+
+func (dbSuper *DBSuper) userByHandle(handle string) (UserInternal, bool) {
+	for _, user := range dbSuper.UserInternal {
+		if strings.EqualFold(user.Handle, handle) {
+			return user, true
+		}
+	}
+	return UserInternal{}, false
+}
+func (dbSuper *DBSuper) handleTaken(handle string) (bool, error) {
+	_, taken := dbSuper.userByHandle(handle)
+	return taken, nil
+}
+func (dbSuper *DBSuper) resolveHandle(handle string) (int, error) {
+	user, ok := dbSuper.userByHandle(handle)
+	if !ok {
+		return 0, ErrUserNotFound
+	}
+	return user.Id, nil
+}
+
+// backfillEntities parses a chirp logged before entities existed. A chirp
+// logged since then with none parses to none again, as replay sees the
+// same users it was created with.
+func (dbSuper *DBSuper) backfillEntities(chirp *Chirp) {
+	if len(chirp.Entities.Hashtags) == 0 && len(chirp.Entities.Mentions) == 0 {
+		chirp.Entities, _ = parseEntities(chirp.Body, dbSuper.resolveHandle)
+	}
+}
+
+// backfillHandle gives a user logged before handles existed, or with an
+// all-digit handle from before those were refused, the handle they
+// already have, or else one derived from the old handle or their email.
+func (dbSuper *DBSuper) backfillHandle(user UserInternal) string {
+	if known, ok := dbSuper.userById(user.Id); ok && validHandle(known.Handle) {
+		return known.Handle
+	}
+	if user.Handle != "" {
+		handle, _ := freeHandle(user.Handle, dbSuper.handleTaken)
+		return handle
+	}
+	handle, _ := handleFromEmail(user.Email, dbSuper.handleTaken)
+	return handle
+}
+
+// The in-memory backends index chirps by hashtag and by mentioned user,
+// as sorted id lists like chirpOrder.
+func (dbSuper *DBSuper) indexEntities(chirp Chirp) {
+	for _, tag := range chirp.Entities.tags() {
+		dbSuper.hashtags[tag] = insertSorted(dbSuper.hashtags[tag], chirp.Id)
+	}
+	for _, userId := range chirp.Entities.mentioned() {
+		dbSuper.mentions[userId] = insertSorted(dbSuper.mentions[userId], chirp.Id)
+	}
+}
+func (dbSuper *DBSuper) unindexEntities(chirp Chirp) {
+	for _, tag := range chirp.Entities.tags() {
+		dbSuper.hashtags[tag] = removeSorted(dbSuper.hashtags[tag], chirp.Id)
+		if len(dbSuper.hashtags[tag]) == 0 {
+			delete(dbSuper.hashtags, tag)
+		}
+	}
+	for _, userId := range chirp.Entities.mentioned() {
+		dbSuper.mentions[userId] = removeSorted(dbSuper.mentions[userId], chirp.Id)
+		if len(dbSuper.mentions[userId]) == 0 {
+			delete(dbSuper.mentions, userId)
+		}
+	}
+}
+func insertSorted(ids []int, id int) []int {
+	i := sort.SearchInts(ids, id)
+	if i < len(ids) && ids[i] == id {
+		return ids
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
+func removeSorted(ids []int, id int) []int {
+	i := sort.SearchInts(ids, id)
+	if i < len(ids) && ids[i] == id {
+		return append(ids[:i], ids[i+1:]...)
+	}
+	return ids
+}
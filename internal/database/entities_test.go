@@ -0,0 +1,144 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidHandle(t *testing.T) {
+	for handle, want := range map[string]bool{
+		"alice":            true,
+		"Alice_99":         true,
+		"_":                true,
+		"007bond":          true,
+		"":                 false,
+		"12345":            false,
+		"0":                false,
+		"alice.b":          false,
+		"élise":            false,
+		"sixteen_letters_": false,
+	} {
+		if got := validHandle(handle); got != want {
+			t.Errorf("validHandle(%q) = %v, want %v", handle, got, want)
+		}
+	}
+}
+
+func TestHandleFromEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		taken []string
+		want  string
+	}{
+		{email: "alice@example.com", want: "alice"},
+		{email: "Alice.B+news@example.com", want: "alicebnews"},
+		{email: "alice@example.com", taken: []string{"alice", "alice2"}, want: "alice3"},
+		{email: "12345@example.com", want: "user12345"},
+		{email: "12345@example.com", taken: []string{"user12345"}, want: "user123452"},
+		{email: "123456789012345@example.com", want: "user12345678901"},
+		{email: "1.2@example.com", want: "user12"},
+		{email: "élise@example.com", want: "lise"},
+		{email: "...@example.com", want: "user"},
+		{email: "averyveryverylongname@example.com", taken: []string{"averyveryverylo"}, want: "averyveryveryl2"},
+	}
+	for _, tt := range tests {
+		got, err := handleFromEmail(tt.email, func(handle string) (bool, error) {
+			return containsString(tt.taken, handle), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want || !validHandle(got) {
+			t.Errorf("handleFromEmail(%q) with %v taken = %q, want %q", tt.email, tt.taken, got, tt.want)
+		}
+	}
+}
+
+func TestParseEntities(t *testing.T) {
+	users := map[string]int{"alice": 1, "bob": 2}
+	resolve := func(handle string) (int, error) {
+		if id, ok := users[strings.ToLower(handle)]; ok {
+			return id, nil
+		}
+		return 0, ErrUserNotFound
+	}
+	tests := []struct {
+		body string
+		want Entities
+	}{
+		{"#go @alice", Entities{
+			Hashtags: []Hashtag{{Tag: "go", Start: 0, End: 3}},
+			Mentions: []Mention{{Handle: "alice", UserId: 1, Start: 4, End: 10}},
+		}},
+		{"héllo 🎉 #go @Alice", Entities{
+			Hashtags: []Hashtag{{Tag: "go", Start: 8, End: 11}},
+			Mentions: []Mention{{Handle: "Alice", UserId: 1, Start: 12, End: 18}},
+		}},
+		{"#café́ 🎉", Entities{Hashtags: []Hashtag{{Tag: "café́", Start: 0, End: 6}}}},
+		{"#go! #rust, (#zig) @bob. @alice's", Entities{
+			Hashtags: []Hashtag{{Tag: "go", Start: 0, End: 3}, {Tag: "rust", Start: 5, End: 10}, {Tag: "zig", Start: 13, End: 17}},
+			Mentions: []Mention{{Handle: "bob", UserId: 2, Start: 19, End: 23}, {Handle: "alice", UserId: 1, Start: 25, End: 31}},
+		}},
+		{"a#b me@alice.com c# x@bob", Entities{}},
+		{"#123 #_ # @ @12345", Entities{}},
+		{"#C99 ##go", Entities{Hashtags: []Hashtag{{Tag: "C99", Start: 0, End: 4}, {Tag: "go", Start: 6, End: 9}}}},
+		{"@carol @aliceé @sixteen_letters_", Entities{}},
+		{"@carol and @bob", Entities{Mentions: []Mention{{Handle: "bob", UserId: 2, Start: 11, End: 15}}}},
+	}
+	for _, tt := range tests {
+		got, err := parseEntities(tt.body, resolve)
+		if err != nil {
+			t.Fatalf("parseEntities(%q): %v", tt.body, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseEntities(%q) = %+v, want %+v", tt.body, got, tt.want)
+		}
+	}
+
+	broken := errors.New("lookup failed")
+	_, err := parseEntities("hi @alice", func(string) (int, error) { return 0, broken })
+	if !errors.Is(err, broken) {
+		t.Errorf("parseEntities with a failing lookup = %v, want its error", err)
+	}
+}
+
+func TestEntitiesFollowEdits(t *testing.T) {
+	openStores(t, allStores, func(t *testing.T, db Store) {
+		chirp, err := db.CreateChirp("#go with @alice", 1, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chirp.Entities.Hashtags) != 1 || len(chirp.Entities.Mentions) != 1 {
+			t.Fatalf("entities = %+v, want #go and @alice", chirp.Entities)
+		}
+		edited, err := db.UpdateChirp(chirp.Id, 1, "now #Rust")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Entities{Hashtags: []Hashtag{{Tag: "Rust", Start: 4, End: 9}}}
+		if !reflect.DeepEqual(edited.Entities, want) {
+			t.Errorf("entities after editing = %+v, want %+v", edited.Entities, want)
+		}
+		if stored, err := db.GetChirp(chirp.Id); err != nil || !reflect.DeepEqual(stored.Entities, want) {
+			t.Errorf("stored entities after editing = %+v, %v, want %+v", stored.Entities, err, want)
+		}
+		for _, q := range []struct {
+			query ChirpQuery
+			want  string
+		}{
+			{ChirpQuery{Hashtag: "go"}, ""},
+			{ChirpQuery{Hashtag: "rust"}, "1"},
+			{ChirpQuery{MentionOf: 1}, ""},
+		} {
+			chirps, err := db.GetChirps(q.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(chirps); got != q.want {
+				t.Errorf("%+v after editing = %s, want %s", q.query, got, q.want)
+			}
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces path with data without ever leaving a partly
+// written file behind. The previous generation is kept as path.bak, which
+// is linked rather than moved so that path exists throughout.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if errC := f.Close(); err == nil {
+		err = errC
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := keepBackup(path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// keepBackup makes path.bak the current generation of path, with a hard
+// link or, where the file system has none, a copy.
+func keepBackup(path string) error {
+	bak := backupPath(path)
+	if err := os.Remove(bak); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err := os.Link(path, bak)
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	data, errR := os.ReadFile(path)
+	if errR != nil {
+		return err
+	}
+	return os.WriteFile(bak, data, 0600)
+}
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+func backupPath(path string) string {
+	return path + ".bak"
+}
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,137 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	for _, data := range []string{"first", "second", "third"} {
+		if err := writeFileAtomic(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, want := range map[string]string{path: "third", backupPath(path): "second"} {
+		got, err := os.ReadFile(file)
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v, want %q", filepath.Base(file), got, err, want)
+		}
+	}
+	if fileExists(path + ".tmp") {
+		t.Error("temporary file left behind")
+	}
+}
+
+func TestWriteFileAtomicNeverRemovesPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	if err := writeFileAtomic(path, []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		for i := 1; i <= 200; i++ {
+			if err := writeFileAtomic(path, []byte(strconv.Itoa(i))); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		default:
+		}
+		if _, err := os.ReadFile(path); err != nil {
+			t.Fatalf("reading while it is replaced: %v", err)
+		}
+	}
+}
+
+// TestBackupRecovery damages the snapshot of a store holding chirp 1 in
+// its snapshot and chirp 2 in its log, and checks what reopening it does.
+func TestBackupRecovery(t *testing.T) {
+	tests := []struct {
+		name      string
+		damage    func(t *testing.T, path string)
+		wantErr   bool
+		wantMoved bool
+	}{
+		{
+			name:      "garbled snapshot",
+			damage:    func(t *testing.T, path string) { writeFile(t, path, "{\"Version\": 11, \"DBStruct") },
+			wantMoved: true,
+		},
+		{
+			name:      "empty snapshot",
+			damage:    func(t *testing.T, path string) { writeFile(t, path, "") },
+			wantMoved: true,
+		},
+		{
+			name: "missing snapshot",
+			damage: func(t *testing.T, path string) {
+				if err := os.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "snapshot and backup both garbled",
+			damage: func(t *testing.T, path string) {
+				writeFile(t, path, "garbage")
+				writeFile(t, backupPath(path), "garbage")
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db := openTestDb(t, path)
+			createChirps(t, db, "in the snapshot")
+			db.mux.Lock()
+			if err := db.compact(); err != nil {
+				t.Fatal(err)
+			}
+			db.mux.Unlock()
+			createChirps(t, db, "in the log")
+			crash(db)
+			tt.damage(t, path)
+
+			db, err := NewDb(path)
+			if tt.wantErr {
+				if err == nil {
+					db.Close()
+					t.Fatal("opened a store with no readable snapshot")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for id := 1; id <= 2; id++ {
+				if _, err := db.GetChirp(id); err != nil {
+					t.Errorf("chirp %d after recovery: %v", id, err)
+				}
+			}
+			if got := fileExists(path + ".corrupt"); got != tt.wantMoved {
+				t.Errorf("unreadable snapshot moved aside = %v, want %v", got, tt.wantMoved)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	ErrUserNotFound = errors.New("User not found")
+	ErrFollowSelf   = errors.New("Users can't follow themselves")
+)
+
+// Follow is one edge of the follow graph as seen from the user it was
+// listed for: the other user and when the edge was created.
+type Follow struct {
+	UserId    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (dbSuper *DBSuper) userById(id int) (UserInternal, bool) {
+	for _, user := range dbSuper.UserInternal {
+		if user.Id == id {
+			return user, true
+		}
+	}
+	return UserInternal{}, false
+}
+func (dbSuper *DBSuper) followUser(followerId, followeeId int) (walEntry, error) {
+	if followerId == followeeId {
+		return walEntry{}, ErrFollowSelf
+	}
+	if _, ok := dbSuper.userById(followeeId); !ok {
+		return walEntry{}, ErrUserNotFound
+	}
+	now := time.Now().UTC()
+	return walEntry{Op: opFollowed, UserId: followerId, TargetId: followeeId, Time: &now}, nil
+}
+func (dbSuper *DBSuper) unfollowUser(followerId, followeeId int) (walEntry, error) {
+	if _, ok := dbSuper.userById(followeeId); !ok {
+		return walEntry{}, ErrUserNotFound
+	}
+	return walEntry{Op: opUnfollowed, UserId: followerId, TargetId: followeeId}, nil
+}
+func (dbSuper *DBSuper) isFollowing(followerId, followeeId int) bool {
+	_, ok := dbSuper.Follows[followerId][followeeId]
+	return ok
+}
+func (dbSuper *DBSuper) applyFollow(entry walEntry) {
+	if dbSuper.isFollowing(entry.UserId, entry.TargetId) {
+		return
+	}
+	if dbSuper.Follows[entry.UserId] == nil {
+		dbSuper.Follows[entry.UserId] = map[int]time.Time{}
+	}
+	dbSuper.Follows[entry.UserId][entry.TargetId] = *entry.Time
+	if dbSuper.followers[entry.TargetId] == nil {
+		dbSuper.followers[entry.TargetId] = map[int]time.Time{}
+	}
+	dbSuper.followers[entry.TargetId][entry.UserId] = *entry.Time
+}
+func (dbSuper *DBSuper) applyUnfollow(entry walEntry) {
+	delete(dbSuper.Follows[entry.UserId], entry.TargetId)
+	delete(dbSuper.followers[entry.TargetId], entry.UserId)
+}
+func (dbSuper *DBSuper) indexFollowers() {
+	dbSuper.followers = map[int]map[int]time.Time{}
+	for followerId, followees := range dbSuper.Follows {
+		for followeeId, at := range followees {
+			if dbSuper.followers[followeeId] == nil {
+				dbSuper.followers[followeeId] = map[int]time.Time{}
+			}
+			dbSuper.followers[followeeId][followerId] = at
+		}
+	}
+}
+
+// follows lists the edges newest first.
+func follows(edges map[int]time.Time) []Follow {
+	list := make([]Follow, 0, len(edges))
+	for id, at := range edges {
+		list = append(list, Follow{UserId: id, CreatedAt: at})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.After(list[j].CreatedAt)
+		}
+		return list[i].UserId < list[j].UserId
+	})
+	return list
+}
+func (dbSuper *DBSuper) getFollowers(userId int) ([]Follow, error) {
+	if _, ok := dbSuper.userById(userId); !ok {
+		return nil, ErrUserNotFound
+	}
+	return follows(dbSuper.followers[userId]), nil
+}
+func (dbSuper *DBSuper) getFollowing(userId int) ([]Follow, error) {
+	if _, ok := dbSuper.userById(userId); !ok {
+		return nil, ErrUserNotFound
+	}
+	return follows(dbSuper.Follows[userId]), nil
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestFollowsAndTimeline(t *testing.T) {
+	openStores(t, allStores, func(t *testing.T, db Store) {
+		for _, handle := range []string{"bob", "carol", "dave"} {
+			if _, err := db.CreateUser(handle+"@example.com", "hunter22", handle); err != nil {
+				t.Fatal(err)
+			}
+		}
+		const alice, bob, carol, dave = 1, 2, 3, 4
+
+		if err := db.FollowUser(alice, alice); !errors.Is(err, ErrFollowSelf) {
+			t.Errorf("following yourself = %v, want ErrFollowSelf", err)
+		}
+		if err := db.FollowUser(alice, 99); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("following a missing user = %v, want ErrUserNotFound", err)
+		}
+		if err := db.UnfollowUser(alice, 99); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("unfollowing a missing user = %v, want ErrUserNotFound", err)
+		}
+		for _, followee := range []int{bob, carol, bob} {
+			if err := db.FollowUser(alice, followee); err != nil {
+				t.Fatalf("following %d: %v", followee, err)
+			}
+		}
+		if err := db.UnfollowUser(alice, dave); err != nil {
+			t.Errorf("unfollowing a user who isn't followed = %v, want a no-op", err)
+		}
+		following, err := db.GetFollowing(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(following) != 2 {
+			t.Errorf("alice follows %+v, want bob and carol once each", following)
+		}
+		followers, err := db.GetFollowers(bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(followers) != 1 || followers[0].UserId != alice {
+			t.Errorf("bob's followers = %+v, want alice", followers)
+		}
+
+		// Chirps 1 to 8 go round the four users, so bob wrote 2 and 6,
+		// carol 3 and 7 and dave 4 and 8.
+		for n := 1; n <= 8; n++ {
+			if _, err := db.CreateChirp(fmt.Sprint("chirp ", n), (n-1)%4+1, 0, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.DeleteChirp(7, carol); err != nil {
+			t.Fatal(err)
+		}
+		timeline := func(q ChirpQuery) string {
+			t.Helper()
+			q.FollowedBy = alice
+			chirps, err := db.GetChirps(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ids(chirps)
+		}
+		steps := []struct {
+			name   string
+			change func() error
+			q      ChirpQuery
+			want   string
+		}{
+			{"followees only", nil, ChirpQuery{Desc: true}, "6,3,2"},
+			{"ascending", nil, ChirpQuery{}, "2,3,6"},
+			{"paged", nil, ChirpQuery{Desc: true, After: 6, Limit: 1}, "3"},
+			{"paged ascending", nil, ChirpQuery{After: 2, Limit: 1}, "3"},
+			{"unfollowed", func() error { return db.UnfollowUser(alice, bob) }, ChirpQuery{Desc: true}, "3"},
+			{"followed later", func() error { return db.FollowUser(alice, dave) }, ChirpQuery{Desc: true}, "8,4,3"},
+			{"posted after following", func() error {
+				_, err := db.CreateChirp("chirp 9", dave, 0, 0)
+				return err
+			}, ChirpQuery{Desc: true, Limit: 2}, "9,8"},
+		}
+		for _, step := range steps {
+			if step.change != nil {
+				if err := step.change(); err != nil {
+					t.Fatalf("%s: %v", step.name, err)
+				}
+			}
+			if got := timeline(step.q); got != step.want {
+				t.Errorf("%s: timeline %+v = %s, want %s", step.name, step.q, got, step.want)
+			}
+		}
+		chirps, err := db.GetChirps(ChirpQuery{FollowedBy: bob})
+		if err != nil || len(chirps) != 0 {
+			t.Errorf("timeline of a user who follows nobody = %s, %v, want it empty", ids(chirps), err)
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+func (dbSuper *DBSuper) likeChirp(chirpId, userId int) (walEntry, error) {
+	if _, err := dbSuper.getChirp(chirpId); err != nil {
+		return walEntry{}, err
+	}
+	now := time.Now().UTC()
+	return walEntry{Op: opLiked, Id: chirpId, UserId: userId, Time: &now}, nil
+}
+func (dbSuper *DBSuper) unlikeChirp(chirpId, userId int) (walEntry, error) {
+	if _, err := dbSuper.getChirp(chirpId); err != nil {
+		return walEntry{}, err
+	}
+	return walEntry{Op: opUnliked, Id: chirpId, UserId: userId}, nil
+}
+func (dbSuper *DBSuper) isLiked(chirpId, userId int) bool {
+	_, ok := dbSuper.Likes[chirpId][userId]
+	return ok
+}
+func (dbSuper *DBSuper) applyLike(entry walEntry) {
+	if dbSuper.isLiked(entry.Id, entry.UserId) {
+		return
+	}
+	if dbSuper.Likes[entry.Id] == nil {
+		dbSuper.Likes[entry.Id] = map[int]time.Time{}
+	}
+	dbSuper.Likes[entry.Id][entry.UserId] = *entry.Time
+	if dbSuper.liked[entry.UserId] == nil {
+		dbSuper.liked[entry.UserId] = map[int]time.Time{}
+	}
+	dbSuper.liked[entry.UserId][entry.Id] = *entry.Time
+}
+func (dbSuper *DBSuper) applyUnlike(entry walEntry) {
+	delete(dbSuper.Likes[entry.Id], entry.UserId)
+	if len(dbSuper.Likes[entry.Id]) == 0 {
+		delete(dbSuper.Likes, entry.Id)
+	}
+	delete(dbSuper.liked[entry.UserId], entry.Id)
+}
+
+// clearLikes drops every like of a chirp that is being deleted.
+func (dbSuper *DBSuper) clearLikes(chirpId int) {
+	for userId := range dbSuper.Likes[chirpId] {
+		delete(dbSuper.liked[userId], chirpId)
+	}
+	delete(dbSuper.Likes, chirpId)
+}
+func (dbSuper *DBSuper) indexLikes() {
+	dbSuper.liked = map[int]map[int]time.Time{}
+	for chirpId, users := range dbSuper.Likes {
+		for userId, at := range users {
+			if dbSuper.liked[userId] == nil {
+				dbSuper.liked[userId] = map[int]time.Time{}
+			}
+			dbSuper.liked[userId][chirpId] = at
+		}
+	}
+}
+
+// getLikedChirps lists the chirps a user likes, most recently liked first.
+func (dbSuper *DBSuper) getLikedChirps(userId int) ([]Chirp, error) {
+	if _, ok := dbSuper.userById(userId); !ok {
+		return nil, ErrUserNotFound
+	}
+	likes := dbSuper.liked[userId]
+	chirps := make([]Chirp, 0, len(likes))
+	for id := range likes {
+		if chirp, err := dbSuper.getChirp(id); err == nil {
+			chirps = append(chirps, chirp)
+		}
+	}
+	sort.Slice(chirps, func(i, j int) bool {
+		a, b := likes[chirps[i].Id], likes[chirps[j].Id]
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return chirps[i].Id > chirps[j].Id
+	})
+	return chirps, nil
+}
@@ -0,0 +1,320 @@
+package database
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type MemDB struct {
+	data DBSuper
+	mux  *sync.RWMutex
+}
+
+func NewMemDb() *MemDB {
+	return &MemDB{
+		data: newDBSuper(),
+		mux:  &sync.RWMutex{},
+	}
+}
+
+// apply applies entries in order, stopping at the first one rejected.
+func (db *MemDB) apply(entries ...walEntry) error {
+	for _, entry := range entries {
+		if err := db.data.apply(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (db *MemDB) IssueRefreshToken(userId int, ttl time.Duration, client Client) (IssuedToken, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, issued, err := db.data.issueRefreshToken(userId, ttl, client)
+	if err != nil {
+		return IssuedToken{}, err
+	}
+	return issued, db.data.apply(entry)
+}
+func (db *MemDB) RotateRefreshToken(token string, ttl time.Duration, client Client) (IssuedToken, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entries, issued, err := db.data.rotateRefreshToken(token, ttl, client)
+	if errA := db.apply(entries...); errA != nil {
+		return IssuedToken{}, errA
+	}
+	return issued, err
+}
+func (db *MemDB) RevokeRefreshToken(token string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.revokeRefreshToken(token)
+	if err != nil {
+		return err
+	}
+	return db.data.apply(entry)
+}
+func (db *MemDB) PurgeRefreshTokens(before time.Time) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entries := db.data.purgeRefreshTokens(before)
+	return len(entries), db.apply(entries...)
+}
+func (db *MemDB) ListSessions(userId int) ([]Session, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.listSessions(userId), nil
+}
+func (db *MemDB) GetSession(id string) (Session, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getSession(id)
+}
+func (db *MemDB) RevokeSession(userId int, id string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.revokeSession(userId, id)
+	if err != nil {
+		return err
+	}
+	return db.data.apply(entry)
+}
+func (db *MemDB) RevokeOtherSessions(userId int, keep string) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entries := db.data.revokeOtherSessions(userId, keep)
+	return len(entries), db.apply(entries...)
+}
+func (db *MemDB) FlagChirp(chirpId int, flags []Flag) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.flagChirp(chirpId, flags)
+	if err != nil {
+		return err
+	}
+	return db.data.apply(entry)
+}
+func (db *MemDB) GetFlags(limit int) ([]Flag, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getFlags(limit), nil
+}
+func (db *MemDB) CreateUser(email, password, handle string) (UserResponse, error) {
+	hash, err := createUserPassword(password)
+	if err != nil {
+		return UserResponse{}, err
+	}
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.createUser(email, hash, handle)
+	if err != nil {
+		return UserResponse{}, err
+	}
+	if err := db.data.apply(entry); err != nil {
+		return UserResponse{}, err
+	}
+	return userResponse(entry.User), nil
+}
+func (db *MemDB) GetUser(id int) (UserResponse, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getUser(id)
+}
+func (db *MemDB) GetUserByHandle(handle string) (UserResponse, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getUserByHandle(handle)
+}
+func (db *MemDB) GetProfile(id int) (Profile, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getProfile(id)
+}
+func (db *MemDB) UserLogin(email, password string) (UserResponse, error) {
+	db.mux.RLock()
+	user, ok := db.data.userByEmail(email)
+	db.mux.RUnlock()
+	return checkLogin(user, ok, password)
+}
+func (db *MemDB) UpdateUser(id int, update UserUpdate) (UserResponse, error) {
+	if update.Password != nil {
+		db.mux.RLock()
+		hash, err := db.data.passwordHash(id)
+		db.mux.RUnlock()
+		if err != nil {
+			return UserResponse{}, err
+		}
+		if err := update.hashPassword(hash); err != nil {
+			return UserResponse{}, err
+		}
+	}
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.updateUser(id, update)
+	if err != nil {
+		return UserResponse{}, err
+	}
+	if err := db.data.apply(entry); err != nil {
+		return UserResponse{}, err
+	}
+	return userResponse(entry.User), nil
+}
+func (db *MemDB) CreateChirp(body string, authorId, inReplyTo, quoteOf int) (Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.createChirp(body, authorId, inReplyTo, quoteOf)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if err := db.data.apply(entry); err != nil {
+		return Chirp{}, err
+	}
+	return *entry.Chirp, nil
+}
+func (db *MemDB) GetChirps(q ChirpQuery) ([]Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.queryChirps(q), nil
+}
+func (db *MemDB) GetChirp(id int) (Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getChirp(id)
+}
+func (db *MemDB) GetThread(id int) (Thread, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getThread(id)
+}
+func (db *MemDB) UpdateChirp(id, authorId int, body string) (Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.updateChirp(id, authorId, body)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if err := db.data.apply(entry); err != nil {
+		return Chirp{}, err
+	}
+	return *entry.Chirp, nil
+}
+func (db *MemDB) GetChirpHistory(id int) ([]ChirpRevision, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getChirpHistory(id)
+}
+func (db *MemDB) SearchChirps(q SearchQuery) ([]Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.searchChirps(q)
+}
+func (db *MemDB) DeleteChirp(id, authorId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.deleteChirp(id, authorId)
+	if err != nil {
+		return err
+	}
+	return db.data.apply(entry)
+}
+func (db *MemDB) RestoreChirp(id, authorId int, window time.Duration) (Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.restoreChirp(id, authorId, window)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if err := db.data.apply(entry); err != nil {
+		return Chirp{}, err
+	}
+	return db.data.DBStructure.Chirps[id], nil
+}
+func (db *MemDB) PurgeChirps(before time.Time) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entries := db.data.purgeChirps(before)
+	return len(entries), db.apply(entries...)
+}
+func (db *MemDB) FollowUser(followerId, followeeId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.followUser(followerId, followeeId)
+	if err != nil {
+		return err
+	}
+	return db.data.apply(entry)
+}
+func (db *MemDB) UnfollowUser(followerId, followeeId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.unfollowUser(followerId, followeeId)
+	if err != nil {
+		return err
+	}
+	return db.data.apply(entry)
+}
+func (db *MemDB) GetFollowers(userId int) ([]Follow, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getFollowers(userId)
+}
+func (db *MemDB) GetFollowing(userId int) ([]Follow, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getFollowing(userId)
+}
+func (db *MemDB) LikeChirp(chirpId, userId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.likeChirp(chirpId, userId)
+	if err != nil {
+		return err
+	}
+	return db.data.apply(entry)
+}
+func (db *MemDB) UnlikeChirp(chirpId, userId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.unlikeChirp(chirpId, userId)
+	if err != nil {
+		return err
+	}
+	return db.data.apply(entry)
+}
+func (db *MemDB) Rechirp(id, authorId int) (Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.rechirp(id, authorId)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if err := db.data.apply(entry); err != nil {
+		return Chirp{}, err
+	}
+	return *entry.Chirp, nil
+}
+func (db *MemDB) Unrechirp(id, authorId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	entry, err := db.data.unrechirp(id, authorId)
+	if errors.Is(err, errNotRechirped) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return db.data.apply(entry)
+}
+func (db *MemDB) ChirpStats(ids []int, userId int) (map[int]ChirpStats, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.chirpStats(ids, userId), nil
+}
+func (db *MemDB) GetLikedChirps(userId int) ([]Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.data.getLikedChirps(userId)
+}
+func (db *MemDB) Close() error {
+	return nil
+}
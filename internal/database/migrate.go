@@ -0,0 +1,499 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations upgrade the JSON snapshot one schema version at a time. They
+// run on the decoded document before it is unmarshalled into DBSuper, so
+// they can rename and drop fields the structs no longer know about. New
+// migrations are appended with the next version number.
+type migration struct {
+	version int
+	name    string
+	up      func(doc map[string]any) error
+}
+
+var migrations = []migration{
+	{1, "initialize missing chirp and revoked token collections", func(doc map[string]any) error {
+		structure := object(doc, "DBStructure")
+		if structure["chirps"] == nil {
+			structure["chirps"] = map[string]any{}
+		}
+		if doc["RevokedTokens"] == nil {
+			doc["RevokedTokens"] = map[string]any{}
+		}
+		return nil
+	}},
+	{2, "rename usreamount to user_amount", func(doc map[string]any) error {
+		structure := object(doc, "DBStructure")
+		if amount, ok := structure["usreamount"]; ok {
+			structure["user_amount"] = amount
+			delete(structure, "usreamount")
+		}
+		return nil
+	}},
+	{3, "drop unused DBStructure.User", func(doc map[string]any) error {
+		delete(object(doc, "DBStructure"), "User")
+		return nil
+	}},
+	{4, "track the highest chirp id in chirp_amount", func(doc map[string]any) error {
+		structure := object(doc, "DBStructure")
+		maxId := 0
+		for key := range object(structure, "chirps") {
+			id, err := strconv.Atoi(key)
+			if err != nil {
+				return err
+			}
+			if id > maxId {
+				maxId = id
+			}
+		}
+		structure["chirp_amount"] = maxId
+		return nil
+	}},
+	{5, "add chirp revisions and backfill chirp timestamps with the time of migration", func(doc map[string]any) error {
+		structure := object(doc, "DBStructure")
+		if structure["revisions"] == nil {
+			structure["revisions"] = map[string]any{}
+		}
+		now := time.Now().UTC()
+		for _, chirp := range object(structure, "chirps") {
+			chirp, ok := chirp.(map[string]any)
+			if !ok {
+				continue
+			}
+			if chirp["created_at"] == nil {
+				chirp["created_at"] = now
+				chirp["updated_at"] = now
+			}
+		}
+		return nil
+	}},
+	{6, "add the follow graph", func(doc map[string]any) error {
+		if doc["Follows"] == nil {
+			doc["Follows"] = map[string]any{}
+		}
+		return nil
+	}},
+	{7, "start a conversation at every existing chirp", func(doc map[string]any) error {
+		for key, chirp := range object(object(doc, "DBStructure"), "chirps") {
+			chirp, ok := chirp.(map[string]any)
+			if !ok {
+				continue
+			}
+			if chirp["conversation_id"] == nil {
+				id, err := strconv.Atoi(key)
+				if err != nil {
+					return err
+				}
+				chirp["conversation_id"] = id
+			}
+		}
+		return nil
+	}},
+	{8, "add chirp likes", func(doc map[string]any) error {
+		if doc["Likes"] == nil {
+			doc["Likes"] = map[string]any{}
+		}
+		return nil
+	}},
+	{9, "give every user a handle and parse hashtags and mentions out of chirps", func(doc map[string]any) error {
+		users, _ := doc["UserInternal"].([]any)
+		handles := map[string]int{}
+		for _, user := range users {
+			user, ok := user.(map[string]any)
+			if !ok {
+				continue
+			}
+			handle, _ := user["handle"].(string)
+			if handle == "" {
+				email, _ := user["email"].(string)
+				handle, _ = handleFromEmail(email, func(handle string) (bool, error) {
+					_, taken := handles[strings.ToLower(handle)]
+					return taken, nil
+				})
+				user["handle"] = handle
+			}
+			id, _ := user["id"].(float64)
+			handles[strings.ToLower(handle)] = int(id)
+		}
+		for _, chirp := range object(object(doc, "DBStructure"), "chirps") {
+			chirp, ok := chirp.(map[string]any)
+			if !ok {
+				continue
+			}
+			body, _ := chirp["body"].(string)
+			entities, err := parseEntities(body, func(handle string) (int, error) {
+				if id, ok := handles[strings.ToLower(handle)]; ok {
+					return id, nil
+				}
+				return 0, ErrUserNotFound
+			})
+			if err != nil {
+				return err
+			}
+			chirp["entities"] = entities
+		}
+		return nil
+	}},
+	{10, "replace the refresh token denylist with stored refresh tokens", func(doc map[string]any) error {
+		delete(doc, "RevokedTokens")
+		if doc["RefreshTokens"] == nil {
+			doc["RefreshTokens"] = map[string]any{}
+		}
+		return nil
+	}},
+	{11, "record a session for every refresh token family", func(doc map[string]any) error {
+		data, err := json.Marshal(doc["RefreshTokens"])
+		if err != nil {
+			return err
+		}
+		var tokens map[string]RefreshToken
+		if err := json.Unmarshal(data, &tokens); err != nil {
+			return err
+		}
+		doc["Sessions"] = sessionsOf(tokens)
+		return nil
+	}},
+	{12, "keep chirps flagged for review", func(doc map[string]any) error {
+		if doc["Flags"] == nil {
+			doc["Flags"] = []any{}
+		}
+		return nil
+	}},
+	{13, "give users with an all-digit handle one that isn't read as a user id", func(doc map[string]any) error {
+		users, _ := doc["UserInternal"].([]any)
+		handles := map[string]bool{}
+		for _, user := range users {
+			if user, ok := user.(map[string]any); ok {
+				handle, _ := user["handle"].(string)
+				handles[strings.ToLower(handle)] = true
+			}
+		}
+		for _, user := range users {
+			user, ok := user.(map[string]any)
+			if !ok {
+				continue
+			}
+			handle, _ := user["handle"].(string)
+			if handle == "" || !allDigits(handle) {
+				continue
+			}
+			handle, _ = freeHandle(handle, func(handle string) (bool, error) {
+				return handles[strings.ToLower(handle)], nil
+			})
+			user["handle"] = handle
+			handles[handle] = true
+		}
+		return nil
+	}},
+}
+
+var schemaVersion = migrations[len(migrations)-1].version
+
+func object(doc map[string]any, key string) map[string]any {
+	obj, ok := doc[key].(map[string]any)
+	if !ok {
+		obj = map[string]any{}
+		doc[key] = obj
+	}
+	return obj
+}
+func documentVersion(doc map[string]any) int {
+	version, _ := doc["Version"].(float64)
+	return int(version)
+}
+func pendingMigrations(version int) ([]migration, error) {
+	if version > schemaVersion {
+		return nil, fmt.Errorf("Database schema version %d is newer than this build supports (%d)", version, schemaVersion)
+	}
+	var pending []migration
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// migrateSnapshot brings an encoded snapshot up to schemaVersion.
+func migrateSnapshot(path string, data []byte) ([]byte, error) {
+	doc := map[string]any{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	pending, err := pendingMigrations(documentVersion(doc))
+	if err != nil || len(pending) == 0 {
+		return data, err
+	}
+	for _, m := range pending {
+		log.Printf("Migrating %s to schema version %d: %s", path, m.version, m.name)
+		if err := m.up(doc); err != nil {
+			return nil, fmt.Errorf("Migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		doc["Version"] = m.version
+	}
+	return json.Marshal(doc)
+}
+
+// MigrateFile upgrades the JSON database at path and returns a description
+// of every migration that ran. With dryRun it only reports what would run.
+func MigrateFile(path string, dryRun bool) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]any{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	pending, err := pendingMigrations(documentVersion(doc))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, m := range pending {
+		names = append(names, fmt.Sprintf("%d: %s", m.version, m.name))
+	}
+	if dryRun || len(pending) == 0 {
+		return names, nil
+	}
+	db, err := NewDb(path)
+	if err != nil {
+		return nil, err
+	}
+	return names, db.Close()
+}
+
+// A SQLite migration runs stmt and then, when set, fn in the same
+// transaction, for backfills that need Go.
+type sqliteMigration struct {
+	version int
+	name    string
+	stmt    string
+	fn      func(tx *sql.Tx) error
+}
+
+// The SQLite schema is versioned through PRAGMA user_version.
+var sqliteMigrations = []sqliteMigration{
+	{1, "create users, chirps and revoked_tokens", `
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT NOT NULL UNIQUE,
+	password BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS chirps (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	body TEXT NOT NULL,
+	author_id INTEGER NOT NULL REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS idx_chirps_author_id ON chirps(author_id);
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	token TEXT PRIMARY KEY,
+	revoked_at TIMESTAMP NOT NULL
+);
+`, nil},
+	{2, "soft-delete chirps", `
+ALTER TABLE chirps ADD COLUMN deleted_at INTEGER;
+CREATE INDEX idx_chirps_deleted_at ON chirps(deleted_at);
+`, nil},
+	{3, "chirp timestamps and revisions", `
+ALTER TABLE chirps ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chirps ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+UPDATE chirps SET created_at = CAST(strftime('%s', 'now') AS INTEGER) * 1000, updated_at = CAST(strftime('%s', 'now') AS INTEGER) * 1000;
+CREATE TABLE chirp_revisions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	chirp_id INTEGER NOT NULL REFERENCES chirps(id) ON DELETE CASCADE,
+	body TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX idx_chirp_revisions_chirp_id ON chirp_revisions(chirp_id);
+`, nil},
+	{4, "index chirps for filtered listing", `
+DROP INDEX idx_chirps_author_id;
+CREATE INDEX idx_chirps_author_id ON chirps(author_id, id);
+CREATE INDEX idx_chirps_created_at ON chirps(created_at);
+`, nil},
+	{5, "full-text index on chirp bodies", `
+CREATE VIRTUAL TABLE chirps_fts USING fts5(body, content='chirps', content_rowid='id', tokenize='unicode61');
+INSERT INTO chirps_fts(chirps_fts) VALUES ('rebuild');
+CREATE TRIGGER chirps_fts_insert AFTER INSERT ON chirps BEGIN
+	INSERT INTO chirps_fts(rowid, body) VALUES (new.id, new.body);
+END;
+CREATE TRIGGER chirps_fts_delete AFTER DELETE ON chirps BEGIN
+	INSERT INTO chirps_fts(chirps_fts, rowid, body) VALUES ('delete', old.id, old.body);
+END;
+CREATE TRIGGER chirps_fts_update AFTER UPDATE OF body ON chirps BEGIN
+	INSERT INTO chirps_fts(chirps_fts, rowid, body) VALUES ('delete', old.id, old.body);
+	INSERT INTO chirps_fts(rowid, body) VALUES (new.id, new.body);
+END;
+`, nil},
+	{6, "follow graph", `
+CREATE TABLE follows (
+	follower_id INTEGER NOT NULL REFERENCES users(id),
+	followee_id INTEGER NOT NULL REFERENCES users(id),
+	created_at INTEGER NOT NULL,
+	PRIMARY KEY (follower_id, followee_id)
+);
+CREATE INDEX idx_follows_followee_id ON follows(followee_id, follower_id);
+`, nil},
+	{7, "reply threads", `
+ALTER TABLE chirps ADD COLUMN in_reply_to INTEGER REFERENCES chirps(id) ON DELETE SET NULL;
+ALTER TABLE chirps ADD COLUMN conversation_id INTEGER NOT NULL DEFAULT 0;
+UPDATE chirps SET conversation_id = id;
+CREATE INDEX idx_chirps_in_reply_to ON chirps(in_reply_to);
+CREATE INDEX idx_chirps_conversation_id ON chirps(conversation_id, id);
+`, nil},
+	{8, "chirp likes", `
+CREATE TABLE likes (
+	chirp_id INTEGER NOT NULL REFERENCES chirps(id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	created_at INTEGER NOT NULL,
+	PRIMARY KEY (chirp_id, user_id)
+);
+CREATE INDEX idx_likes_user_id ON likes(user_id, created_at);
+`, nil},
+	{9, "rechirps and quote chirps", `
+ALTER TABLE chirps ADD COLUMN rechirp_of INTEGER;
+ALTER TABLE chirps ADD COLUMN quote_of INTEGER;
+CREATE INDEX idx_chirps_rechirp_of ON chirps(rechirp_of);
+CREATE INDEX idx_chirps_quote_of ON chirps(quote_of);
+CREATE UNIQUE INDEX idx_chirps_active_rechirp ON chirps(author_id, rechirp_of) WHERE rechirp_of IS NOT NULL AND deleted_at IS NULL;
+`, nil},
+	{10, "user handles, hashtags and mentions", `
+ALTER TABLE users ADD COLUMN handle TEXT;
+CREATE UNIQUE INDEX idx_users_handle ON users(handle COLLATE NOCASE);
+ALTER TABLE chirps ADD COLUMN entities TEXT NOT NULL DEFAULT '{}';
+CREATE TABLE chirp_hashtags (
+	chirp_id INTEGER NOT NULL REFERENCES chirps(id) ON DELETE CASCADE,
+	tag TEXT NOT NULL,
+	PRIMARY KEY (tag, chirp_id)
+);
+CREATE INDEX idx_chirp_hashtags_chirp_id ON chirp_hashtags(chirp_id);
+CREATE TABLE chirp_mentions (
+	chirp_id INTEGER NOT NULL REFERENCES chirps(id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	PRIMARY KEY (user_id, chirp_id)
+);
+CREATE INDEX idx_chirp_mentions_chirp_id ON chirp_mentions(chirp_id);
+`, backfillEntitiesSQLite},
+	{11, "user profiles", `
+ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT '';
+`, nil},
+	{12, "stored refresh tokens replace the denylist", `
+DROP TABLE revoked_tokens;
+CREATE TABLE refresh_tokens (
+	hash TEXT PRIMARY KEY,
+	family_id TEXT NOT NULL,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	rotated_at INTEGER,
+	revoked_at INTEGER
+);
+CREATE INDEX idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+CREATE INDEX idx_refresh_tokens_expires_at ON refresh_tokens(expires_at);
+`, nil},
+	{13, "sessions", `
+CREATE TABLE sessions (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	ip TEXT NOT NULL,
+	user_agent TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	last_used_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	revoked_at INTEGER
+);
+CREATE INDEX idx_sessions_user_id ON sessions(user_id);
+INSERT INTO sessions (id, user_id, ip, user_agent, created_at, last_used_at, expires_at, revoked_at)
+	SELECT family_id, user_id, '', '', MIN(created_at), MAX(created_at), MAX(expires_at), MAX(revoked_at)
+	FROM refresh_tokens GROUP BY family_id;
+`, nil},
+	{14, "chirps flagged for review", `
+CREATE TABLE flags (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	chirp_id INTEGER NOT NULL REFERENCES chirps(id) ON DELETE CASCADE,
+	rule TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	start_offset INTEGER NOT NULL,
+	end_offset INTEGER NOT NULL,
+	flagged_at INTEGER NOT NULL
+);
+CREATE INDEX idx_flags_chirp_id ON flags(chirp_id);
+`, nil},
+	{15, "handles that aren't all digits", ``, rehandleDigitsSQLite},
+}
+
+func pendingSQLiteMigrations(db *sql.DB) ([]sqliteMigration, error) {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return nil, err
+	}
+	latest := sqliteMigrations[len(sqliteMigrations)-1].version
+	if version > latest {
+		return nil, fmt.Errorf("Database schema version %d is newer than this build supports (%d)", version, latest)
+	}
+	var pending []sqliteMigration
+	for _, m := range sqliteMigrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+func migrateSQLite(db *sql.DB, dryRun bool) ([]string, error) {
+	pending, err := pendingSQLiteMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, m := range pending {
+		names = append(names, fmt.Sprintf("%d: %s", m.version, m.name))
+		if dryRun {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(m.stmt); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("Migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		if m.fn != nil {
+			if err := m.fn(tx); err != nil {
+				tx.Rollback()
+				return nil, fmt.Errorf("Migration %d (%s) failed: %w", m.version, m.name, err)
+			}
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, m.version)); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// MigrateSQLite is MigrateFile for the SQLite backend.
+func MigrateSQLite(path string, dryRun bool) ([]string, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrateSQLite(db, dryRun)
+}
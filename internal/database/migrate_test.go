@@ -0,0 +1,249 @@
+package database
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// baselineSnapshot is a database.json as written before the schema was
+// versioned.
+const baselineSnapshot = `{
+	"DBStructure": {
+		"chirps": {
+			"1": {"id": 1, "body": "hello #Chirpy @alice", "author_id": 1},
+			"3": {"id": 3, "body": "third", "author_id": 2}
+		},
+		"User": {"id": 0, "email": ""},
+		"usreamount": 3
+	},
+	"UserInternal": [
+		{"id": 1, "email": "alice@example.com", "password": "JDJhJDE0JA=="},
+		{"id": 2, "email": "alice@example.org", "password": "JDJhJDE0JA=="}
+	],
+	"RevokedTokens": {"old.jwt": "2024-03-26T10:00:00Z"}
+}`
+
+func TestMigrationsAreNumberedInOrder(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %q is version %d, want %d", m.name, m.version, i+1)
+		}
+	}
+	for i, m := range sqliteMigrations {
+		if m.version != i+1 {
+			t.Errorf("SQLite migration %q is version %d, want %d", m.name, m.version, i+1)
+		}
+	}
+}
+
+func TestMigrateSnapshotFromBaseline(t *testing.T) {
+	data, err := migrateSnapshot("database.json", []byte(baselineSnapshot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := map[string]any{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc["RevokedTokens"]; ok {
+		t.Error("RevokedTokens survived migration")
+	}
+	structure := object(doc, "DBStructure")
+	for _, key := range []string{"User", "usreamount"} {
+		if _, ok := structure[key]; ok {
+			t.Errorf("DBStructure.%s survived migration", key)
+		}
+	}
+
+	var dbSuper DBSuper
+	if err := json.Unmarshal(data, &dbSuper); err != nil {
+		t.Fatal(err)
+	}
+	if dbSuper.Version != schemaVersion {
+		t.Errorf("version = %d, want %d", dbSuper.Version, schemaVersion)
+	}
+	if got := dbSuper.DBStructure.UserAmount; got != 3 {
+		t.Errorf("user_amount = %d, want 3", got)
+	}
+	if got := dbSuper.DBStructure.ChirpAmount; got != 3 {
+		t.Errorf("chirp_amount = %d, want the highest id 3", got)
+	}
+	for id, chirp := range dbSuper.DBStructure.Chirps {
+		if chirp.CreatedAt.IsZero() || chirp.UpdatedAt.IsZero() {
+			t.Errorf("chirp %d has no timestamps", id)
+		}
+		if chirp.ConversationId != id {
+			t.Errorf("chirp %d is in conversation %d, want its own", id, chirp.ConversationId)
+		}
+	}
+	entities := dbSuper.DBStructure.Chirps[1].Entities
+	if len(entities.Hashtags) != 1 || entities.Hashtags[0].Tag != "Chirpy" {
+		t.Errorf("hashtags = %+v, want #Chirpy", entities.Hashtags)
+	}
+	if len(entities.Mentions) != 1 || entities.Mentions[0].UserId != 1 {
+		t.Errorf("mentions = %+v, want @alice as user 1", entities.Mentions)
+	}
+	handles := map[string]bool{}
+	for _, user := range dbSuper.UserInternal {
+		if !validHandle(user.Handle) {
+			t.Errorf("user %d got invalid handle %q", user.Id, user.Handle)
+		}
+		if handles[user.Handle] {
+			t.Errorf("handle %q given to two users", user.Handle)
+		}
+		handles[user.Handle] = true
+	}
+	if dbSuper.Follows == nil || dbSuper.Likes == nil || dbSuper.RefreshTokens == nil || dbSuper.Sessions == nil {
+		t.Error("follows, likes, refresh tokens or sessions not initialized")
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	tests := []struct {
+		version   int
+		wantFirst int
+		wantCount int
+		wantErr   bool
+	}{
+		{version: 0, wantFirst: 1, wantCount: schemaVersion},
+		{version: 5, wantFirst: 6, wantCount: schemaVersion - 5},
+		{version: schemaVersion, wantCount: 0},
+		{version: schemaVersion + 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		pending, err := pendingMigrations(tt.version)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("version %d: no error, want one for a newer schema", tt.version)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("version %d: %v", tt.version, err)
+		}
+		if len(pending) != tt.wantCount {
+			t.Errorf("version %d: %d pending, want %d", tt.version, len(pending), tt.wantCount)
+		}
+		if len(pending) > 0 && pending[0].version != tt.wantFirst {
+			t.Errorf("version %d: first pending is %d, want %d", tt.version, pending[0].version, tt.wantFirst)
+		}
+	}
+}
+
+func TestMigrateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	writeFile(t, path, baselineSnapshot)
+
+	pending, err := MigrateFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != schemaVersion {
+		t.Errorf("dry run lists %d migrations, want %d", len(pending), schemaVersion)
+	}
+	if data, _ := os.ReadFile(path); string(data) != baselineSnapshot {
+		t.Error("dry run changed the file")
+	}
+
+	if applied, err := MigrateFile(path, false); err != nil || len(applied) != schemaVersion {
+		t.Fatalf("migrate = %d applied, %v, want %d", len(applied), err, schemaVersion)
+	}
+	if applied, err := MigrateFile(path, false); err != nil || len(applied) != 0 {
+		t.Errorf("second migrate = %v, %v, want nothing to do", applied, err)
+	}
+	if !fileExists(backupPath(path)) {
+		t.Error("the pre-migration snapshot wasn't kept as the backup")
+	}
+
+	writeFile(t, path, `{"Version": 999}`)
+	if _, err := MigrateFile(path, false); err == nil {
+		t.Error("migrated a snapshot newer than this build")
+	}
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.sqlite")
+	latest := len(sqliteMigrations)
+
+	if pending, err := MigrateSQLite(path, true); err != nil || len(pending) != latest {
+		t.Fatalf("dry run = %d pending, %v, want %d", len(pending), err, latest)
+	}
+	if applied, err := MigrateSQLite(path, false); err != nil || len(applied) != latest {
+		t.Fatalf("migrate = %d applied, %v, want %d", len(applied), err, latest)
+	}
+	if applied, err := MigrateSQLite(path, false); err != nil || len(applied) != 0 {
+		t.Errorf("second migrate = %v, %v, want nothing to do", applied, err)
+	}
+
+	db, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`PRAGMA user_version = 999`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := MigrateSQLite(path, false); err == nil {
+		t.Error("migrated a database newer than this build")
+	}
+}
+
+func TestMigrateDigitHandles(t *testing.T) {
+	data, err := migrateSnapshot("database.json", []byte(`{
+		"Version": 12,
+		"UserInternal": [
+			{"id": 1, "email": "a@example.com", "handle": "12345"},
+			{"id": 2, "email": "b@example.com", "handle": "user12345"},
+			{"id": 3, "email": "c@example.com", "handle": "bob"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dbSuper DBSuper
+	if err := json.Unmarshal(data, &dbSuper); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"user123452", "user12345", "bob"} {
+		if got := dbSuper.UserInternal[i].Handle; got != want {
+			t.Errorf("user %d handle = %q, want %q", i+1, got, want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "database.sqlite")
+	if _, err := MigrateSQLite(path, false); err != nil {
+		t.Fatal(err)
+	}
+	db, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`INSERT INTO users (email, password, handle) VALUES
+		('a@example.com', '', '12345'), ('b@example.com', '', 'user12345'), ('c@example.com', '', 'bob');
+		PRAGMA user_version = 14`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrateSQLite(db, false); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query(`SELECT handle FROM users ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var handles []string
+	for rows.Next() {
+		var handle string
+		if err := rows.Scan(&handle); err != nil {
+			t.Fatal(err)
+		}
+		handles = append(handles, handle)
+	}
+	if got := strings.Join(handles, ","); got != "user123452,user12345,bob" {
+		t.Errorf("SQLite handles = %s, want user123452,user12345,bob", got)
+	}
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"slices"
+	"time"
+)
+
+// Flag is a content filter rule that let a chirp through but wants it
+// reviewed, with Start and End as byte offsets of the hit in its body.
+type Flag struct {
+	ChirpId   int       `json:"chirp_id"`
+	Rule      string    `json:"rule"`
+	Reason    string    `json:"reason,omitempty"`
+	Start     int       `json:"start"`
+	End       int       `json:"end"`
+	FlaggedAt time.Time `json:"flagged_at"`
+}
+
+func (dbSuper *DBSuper) flagChirp(chirpId int, flags []Flag) (walEntry, error) {
+	if _, err := dbSuper.getChirp(chirpId); err != nil {
+		return walEntry{}, err
+	}
+	now := time.Now().UTC()
+	flagged := make([]Flag, len(flags))
+	for i, flag := range flags {
+		flag.ChirpId = chirpId
+		flag.FlaggedAt = now
+		flagged[i] = flag
+	}
+	return walEntry{Op: opChirpFlagged, Id: chirpId, Flags: flagged}, nil
+}
+
+// clearFlags drops the flags of a chirp that is being deleted.
+func (dbSuper *DBSuper) clearFlags(chirpId int) {
+	dbSuper.Flags = slices.DeleteFunc(dbSuper.Flags, func(flag Flag) bool {
+		return flag.ChirpId == chirpId
+	})
+}
+
+// getFlags is the limit most recent flags, oldest first.
+func (dbSuper *DBSuper) getFlags(limit int) []Flag {
+	flags := dbSuper.Flags
+	if len(flags) > limit {
+		flags = flags[len(flags)-limit:]
+	}
+	return append([]Flag{}, flags...)
+}
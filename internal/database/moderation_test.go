@@ -0,0 +1,69 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFlags(t *testing.T) {
+	for _, backend := range persistentStores {
+		t.Run(backend.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := backend.open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.CreateUser("alice@example.com", "hunter22", "alice"); err != nil {
+				t.Fatal(err)
+			}
+			createChirps(t, db, "free giveaway", "another free giveaway")
+			if err := db.FlagChirp(1, []Flag{{Rule: "giveaways", Start: 0, End: 13}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.FlagChirp(2, []Flag{{Rule: "giveaways", Reason: "Spam", Start: 8, End: 21}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.FlagChirp(99, []Flag{{Rule: "giveaways"}}); !errors.Is(err, ErrChirpNotFound) {
+				t.Errorf("flagging a missing chirp = %v, want ErrChirpNotFound", err)
+			}
+			if flags, err := db.GetFlags(1); err != nil || len(flags) != 1 || flags[0].ChirpId != 2 {
+				t.Errorf("GetFlags(1) = %+v, %v, want the newest flag", flags, err)
+			}
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if db, err = backend.open(dir); err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			flags, err := db.GetFlags(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(flags) != 2 {
+				t.Fatalf("got %d flags after reopening, want 2", len(flags))
+			}
+			want := Flag{ChirpId: 2, Rule: "giveaways", Reason: "Spam", Start: 8, End: 21}
+			got := flags[1]
+			if got.FlaggedAt.IsZero() {
+				t.Error("flag has no time")
+			}
+			got.FlaggedAt = time.Time{}
+			if got != want {
+				t.Errorf("flag = %+v, want %+v", got, want)
+			}
+
+			if err := db.DeleteChirp(1, 1); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.PurgeChirps(time.Now().Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			if flags, err := db.GetFlags(10); err != nil || len(flags) != 1 || flags[0].ChirpId != 2 {
+				t.Errorf("flags after purging chirp 1 = %+v, %v, want only chirp 2's", flags, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrEmailTaken         = errors.New("Email already in use")
+	ErrInvalidEmail       = errors.New("Email can't be empty")
+	ErrInvalidPassword    = errors.New("Password can't be empty")
+	ErrWrongPassword      = errors.New("Current password is incorrect")
+	ErrInvalidDisplayName = errors.New("Display names are at most 50 characters on one line")
+	ErrInvalidBio         = errors.New("Bios are at most 160 characters")
+	ErrInvalidAvatar      = errors.New("Avatars are http or https URLs of at most 2048 characters")
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 160
+	maxAvatarLength      = 2048
+)
+
+// UserUpdate changes the fields of a user that aren't nil. Changing the
+// password takes the current one.
+type UserUpdate struct {
+	Email           *string
+	Password        *string
+	CurrentPassword string
+	Handle          *string
+	DisplayName     *string
+	Bio             *string
+	AvatarURL       *string
+
+	// checkedHash is the stored hash CurrentPassword was checked against
+	// and newHash the hash of Password, both set by hashPassword.
+	checkedHash, newHash []byte
+}
+
+// hashPassword checks CurrentPassword against hash, the user's stored
+// password, and hashes the new one. bcrypt is slow, so stores call it
+// before taking their lock, and apply then only swaps the new hash in if
+// the stored one is still hash.
+func (update *UserUpdate) hashPassword(hash []byte) error {
+	if update.Password == nil {
+		return nil
+	}
+	if *update.Password == "" {
+		return ErrInvalidPassword
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(update.CurrentPassword)) != nil {
+		return ErrWrongPassword
+	}
+	newHash, err := createUserPassword(*update.Password)
+	if err != nil {
+		return err
+	}
+	update.checkedHash, update.newHash = hash, newHash
+	return nil
+}
+
+// Profile is what anyone can see of a user. It never holds the email.
+type Profile struct {
+	Id             int    `json:"id"`
+	Handle         string `json:"handle"`
+	DisplayName    string `json:"display_name"`
+	Bio            string `json:"bio"`
+	AvatarURL      string `json:"avatar_url"`
+	ChirpCount     int    `json:"chirp_count"`
+	FollowerCount  int    `json:"follower_count"`
+	FollowingCount int    `json:"following_count"`
+}
+
+// apply validates update and makes it on user. emailTaken and
+// handleTaken report whether any user already has an email or handle.
+func (update UserUpdate) apply(user *UserInternal, emailTaken, handleTaken func(string) (bool, error)) error {
+	if update.Email != nil {
+		email := strings.TrimSpace(*update.Email)
+		if email == "" {
+			return ErrInvalidEmail
+		}
+		if email != user.Email {
+			taken, err := emailTaken(email)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return ErrEmailTaken
+			}
+		}
+		user.Email = email
+	}
+	if update.Handle != nil {
+		handle := *update.Handle
+		if !validHandle(handle) {
+			return ErrInvalidHandle
+		}
+		if !strings.EqualFold(handle, user.Handle) {
+			taken, err := handleTaken(handle)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return ErrHandleTaken
+			}
+		}
+		user.Handle = handle
+	}
+	if update.DisplayName != nil {
+		name := strings.TrimSpace(*update.DisplayName)
+		if utf8.RuneCountInString(name) > maxDisplayNameLength || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+			return ErrInvalidDisplayName
+		}
+		user.DisplayName = name
+	}
+	if update.Bio != nil {
+		bio := strings.TrimSpace(*update.Bio)
+		if utf8.RuneCountInString(bio) > maxBioLength {
+			return ErrInvalidBio
+		}
+		user.Bio = bio
+	}
+	if update.AvatarURL != nil {
+		avatar := strings.TrimSpace(*update.AvatarURL)
+		if !validAvatar(avatar) {
+			return ErrInvalidAvatar
+		}
+		user.AvatarURL = avatar
+	}
+	if update.Password != nil {
+		// The password changed since hashPassword checked it, or it
+		// was never called.
+		if update.newHash == nil || !bytes.Equal(user.Password, update.checkedHash) {
+			return ErrWrongPassword
+		}
+		user.Password = update.newHash
+	}
+	return nil
+}
+
+// validAvatar accepts an absolute http or https URL, or nothing to clear
+// the avatar.
+func validAvatar(avatar string) bool {
+	if avatar == "" {
+		return true
+	}
+	if len(avatar) > maxAvatarLength {
+		return false
+	}
+	u, err := url.Parse(avatar)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+func (dbSuper *DBSuper) emailTaken(email string) (bool, error) {
+	for _, user := range dbSuper.UserInternal {
+		if user.Email == email {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (dbSuper *DBSuper) getUserByHandle(handle string) (UserResponse, error) {
+	user, ok := dbSuper.userByHandle(handle)
+	if !ok {
+		return UserResponse{}, ErrUserNotFound
+	}
+	return userResponse(&user), nil
+}
+func (dbSuper *DBSuper) getProfile(id int) (Profile, error) {
+	user, ok := dbSuper.userById(id)
+	if !ok {
+		return Profile{}, ErrUserNotFound
+	}
+	profile := Profile{
+		Id:             user.Id,
+		Handle:         user.Handle,
+		DisplayName:    user.DisplayName,
+		Bio:            user.Bio,
+		AvatarURL:      user.AvatarURL,
+		FollowerCount:  len(dbSuper.followers[id]),
+		FollowingCount: len(dbSuper.Follows[id]),
+	}
+	for _, chirp := range dbSuper.DBStructure.Chirps {
+		if chirp.AuthorId == id && chirp.DeletedAt == nil {
+			profile.ChirpCount++
+		}
+	}
+	return profile, nil
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// ChirpQuery selects a page of chirps. Zero values leave a filter off.
+// Pages are ordered by id, which is also creation order, and After is the
+// id of the last chirp on the previous page.
+type ChirpQuery struct {
+	AuthorId int
+	// FollowedBy limits the page to authors followed by this user.
+	FollowedBy int
+	// Hashtag limits the page to chirps tagged with it, in any case.
+	Hashtag string
+	// MentionOf limits the page to chirps that mention this user.
+	MentionOf int
+	Desc      bool
+	Since     time.Time
+	Until     time.Time
+	After     int
+	Limit     int
+}
+
+func (q ChirpQuery) matches(chirp Chirp) bool {
+	if chirp.DeletedAt != nil {
+		return false
+	}
+	if q.AuthorId != 0 && chirp.AuthorId != q.AuthorId {
+		return false
+	}
+	if q.Hashtag != "" && !containsString(chirp.Entities.tags(), HashtagKey(q.Hashtag)) {
+		return false
+	}
+	if q.MentionOf != 0 && !containsInt(chirp.Entities.mentioned(), q.MentionOf) {
+		return false
+	}
+	if !q.Since.IsZero() && chirp.CreatedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !chirp.CreatedAt.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// reindex rebuilds the lookup structures that aren't stored in the file.
+// It runs whenever a DBSuper is loaded or created.
+func (dbSuper *DBSuper) reindex() {
+	dbSuper.chirpOrder = make([]int, 0, len(dbSuper.DBStructure.Chirps))
+	dbSuper.authored = map[int][]int{}
+	dbSuper.search = newSearchIndex()
+	for id, chirp := range dbSuper.DBStructure.Chirps {
+		dbSuper.chirpOrder = append(dbSuper.chirpOrder, id)
+		if chirp.DeletedAt == nil {
+			dbSuper.search.add(id, chirp.Body)
+		}
+	}
+	sort.Ints(dbSuper.chirpOrder)
+	dbSuper.conversations = map[int][]int{}
+	dbSuper.rechirps = map[int][]int{}
+	dbSuper.quotes = map[int][]int{}
+	dbSuper.hashtags = map[string][]int{}
+	dbSuper.mentions = map[int][]int{}
+	for _, id := range dbSuper.chirpOrder {
+		chirp := dbSuper.DBStructure.Chirps[id]
+		dbSuper.authored[chirp.AuthorId] = append(dbSuper.authored[chirp.AuthorId], id)
+		dbSuper.conversations[chirp.ConversationId] = append(dbSuper.conversations[chirp.ConversationId], id)
+		dbSuper.indexAmplified(chirp)
+		dbSuper.indexEntities(chirp)
+	}
+	dbSuper.indexFollowers()
+	dbSuper.indexLikes()
+	dbSuper.indexFamilies()
+}
+
+// indexChirp adds a chirp to chirpOrder and to its author's chirps.
+func (dbSuper *DBSuper) indexChirp(chirp Chirp) {
+	dbSuper.chirpOrder = insertSorted(dbSuper.chirpOrder, chirp.Id)
+	dbSuper.authored[chirp.AuthorId] = insertSorted(dbSuper.authored[chirp.AuthorId], chirp.Id)
+}
+func (dbSuper *DBSuper) unindexChirp(chirp Chirp) {
+	dbSuper.chirpOrder = removeSorted(dbSuper.chirpOrder, chirp.Id)
+	dbSuper.authored[chirp.AuthorId] = removeSorted(dbSuper.authored[chirp.AuthorId], chirp.Id)
+	if len(dbSuper.authored[chirp.AuthorId]) == 0 {
+		delete(dbSuper.authored, chirp.AuthorId)
+	}
+}
+
+// chirpCursor walks a sorted id list in the order of a page, starting just
+// past the page's After id.
+type chirpCursor struct {
+	ids     []int
+	i, step int
+}
+
+func newChirpCursor(ids []int, q ChirpQuery) *chirpCursor {
+	c := &chirpCursor{ids: ids, step: 1}
+	if q.Desc {
+		c.i, c.step = len(ids)-1, -1
+		if q.After != 0 {
+			c.i = sort.SearchInts(ids, q.After) - 1
+		}
+	} else if q.After != 0 {
+		c.i = sort.SearchInts(ids, q.After+1)
+	}
+	return c
+}
+func (c *chirpCursor) peek() (int, bool) {
+	if c.i < 0 || c.i >= len(c.ids) {
+		return 0, false
+	}
+	return c.ids[c.i], true
+}
+
+// nextChirpId merges cursors, taking the id that comes first in the order
+// of the page.
+func nextChirpId(cursors []*chirpCursor, desc bool) (int, bool) {
+	var next *chirpCursor
+	nextId := 0
+	for _, c := range cursors {
+		id, ok := c.peek()
+		if ok && (next == nil || (desc && id > nextId) || (!desc && id < nextId)) {
+			next, nextId = c, id
+		}
+	}
+	if next == nil {
+		return 0, false
+	}
+	next.i += next.step
+	return nextId, true
+}
+
+// queryChirps walks the narrowest index the query allows. A timeline
+// merges the chirps of each followee, so its pages cost what the followees
+// posted rather than every chirp.
+func (dbSuper *DBSuper) queryChirps(q ChirpQuery) []Chirp {
+	chirps := []Chirp{}
+	var lists [][]int
+	switch {
+	case q.MentionOf != 0:
+		lists = [][]int{dbSuper.mentions[q.MentionOf]}
+	case q.Hashtag != "":
+		lists = [][]int{dbSuper.hashtags[HashtagKey(q.Hashtag)]}
+	case q.AuthorId != 0:
+		lists = [][]int{dbSuper.authored[q.AuthorId]}
+	case q.FollowedBy != 0:
+		for followeeId := range dbSuper.Follows[q.FollowedBy] {
+			lists = append(lists, dbSuper.authored[followeeId])
+		}
+	default:
+		lists = [][]int{dbSuper.chirpOrder}
+	}
+	cursors := make([]*chirpCursor, len(lists))
+	for i, ids := range lists {
+		cursors[i] = newChirpCursor(ids, q)
+	}
+	for {
+		id, ok := nextChirpId(cursors, q.Desc)
+		if !ok {
+			break
+		}
+		chirp := dbSuper.DBStructure.Chirps[id]
+		if !q.matches(chirp) {
+			continue
+		}
+		if q.FollowedBy != 0 && !dbSuper.isFollowing(q.FollowedBy, chirp.AuthorId) {
+			continue
+		}
+		chirps = append(chirps, chirp)
+		if q.Limit > 0 && len(chirps) == q.Limit {
+			break
+		}
+	}
+	return chirps
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ids lists chirps by id, as "1,2,3".
+func ids(chirps []Chirp) string {
+	s := make([]string, len(chirps))
+	for i, chirp := range chirps {
+		s[i] = fmt.Sprint(chirp.Id)
+	}
+	return strings.Join(s, ",")
+}
+
+func TestQueryChirps(t *testing.T) {
+	openStores(t, allStores, func(t *testing.T, db Store) {
+		if _, err := db.CreateUser("bob@example.com", "hunter22", "bob"); err != nil {
+			t.Fatal(err)
+		}
+		// Alice writes the odd chirps and bob the even ones, a little apart
+		// so that since and until can tell them apart.
+		post := func(n int) {
+			t.Helper()
+			time.Sleep(2 * time.Millisecond)
+			if _, err := db.CreateChirp(fmt.Sprint("chirp ", n), 2-n%2, 0, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for n := 1; n <= 6; n++ {
+			post(n)
+		}
+		all, err := db.GetChirps(ChirpQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		created := func(id int) time.Time { return all[id-1].CreatedAt }
+
+		tests := []struct {
+			name string
+			q    ChirpQuery
+			want string
+		}{
+			{"ascending", ChirpQuery{}, "1,2,3,4,5,6"},
+			{"descending", ChirpQuery{Desc: true}, "6,5,4,3,2,1"},
+			{"limit", ChirpQuery{Limit: 2}, "1,2"},
+			{"after", ChirpQuery{After: 2, Limit: 2}, "3,4"},
+			{"after descending", ChirpQuery{Desc: true, After: 5, Limit: 2}, "4,3"},
+			{"after the last", ChirpQuery{After: 6}, ""},
+			{"author", ChirpQuery{AuthorId: 2}, "2,4,6"},
+			{"author descending", ChirpQuery{AuthorId: 2, Desc: true, After: 6}, "4,2"},
+			{"author without chirps", ChirpQuery{AuthorId: 3}, ""},
+			{"since is inclusive", ChirpQuery{Since: created(3)}, "3,4,5,6"},
+			{"until is exclusive", ChirpQuery{Until: created(3)}, "1,2"},
+			{"since and until", ChirpQuery{Since: created(2), Until: created(5)}, "2,3,4"},
+			{"author since", ChirpQuery{AuthorId: 1, Since: created(2)}, "3,5"},
+			{"since and until descending", ChirpQuery{Since: created(2), Until: created(5), Desc: true, Limit: 2}, "4,3"},
+		}
+		for _, tt := range tests {
+			chirps, err := db.GetChirps(tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(chirps); got != tt.want {
+				t.Errorf("%s: %+v = %s, want %s", tt.name, tt.q, got, tt.want)
+			}
+		}
+
+		// Each page continues after the last chirp of the previous one, so
+		// chirps posted or deleted between pages neither repeat nor skip
+		// one that was there throughout.
+		page := func(q ChirpQuery) string {
+			t.Helper()
+			chirps, err := db.GetChirps(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ids(chirps)
+		}
+		del := func(id int) {
+			t.Helper()
+			if err := db.DeleteChirp(id, 2-id%2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		steps := []struct {
+			between func()
+			q       ChirpQuery
+			want    string
+		}{
+			{nil, ChirpQuery{Limit: 2}, "1,2"},
+			{func() { del(3); post(7) }, ChirpQuery{After: 2, Limit: 2}, "4,5"},
+			{func() { del(1); post(8) }, ChirpQuery{After: 5, Limit: 2}, "6,7"},
+			{nil, ChirpQuery{After: 7, Limit: 2}, "8"},
+			{nil, ChirpQuery{After: 8, Limit: 2}, ""},
+			{nil, ChirpQuery{Desc: true, Limit: 2}, "8,7"},
+			{func() { post(9); del(5) }, ChirpQuery{Desc: true, After: 7, Limit: 2}, "6,4"},
+			{func() { del(2) }, ChirpQuery{Desc: true, After: 4, Limit: 2}, ""},
+		}
+		for i, step := range steps {
+			if step.between != nil {
+				step.between()
+			}
+			if got := page(step.q); got != step.want {
+				t.Errorf("page %d: %+v = %s, want %s", i+1, step.q, got, step.want)
+			}
+		}
+	})
+}
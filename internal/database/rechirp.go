@@ -0,0 +1,119 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrOriginalNotFound = errors.New("Original chirp not found")
+	ErrAlreadyRechirped = errors.New("Chirp already rechirped")
+	ErrRechirpEdit      = errors.New("Rechirps can't be edited")
+	errNotRechirped     = errors.New("Chirp not rechirped")
+)
+
+// ChirpStats counts how a chirp was received. Liked is whether the viewer
+// the stats were made for likes it. Deleted rechirps and quotes don't
+// count.
+type ChirpStats struct {
+	Likes    int
+	Liked    bool
+	Rechirps int
+	Quotes   int
+}
+
+// original resolves id to the chirp being amplified: a rechirp stands for
+// the chirp it reposts, so amplifying it amplifies that one instead.
+func (dbSuper *DBSuper) original(id int) (Chirp, error) {
+	chirp, err := dbSuper.getChirp(id)
+	if err != nil {
+		return Chirp{}, ErrOriginalNotFound
+	}
+	if chirp.RechirpOf != nil {
+		if chirp, err = dbSuper.getChirp(*chirp.RechirpOf); err != nil {
+			return Chirp{}, ErrOriginalNotFound
+		}
+	}
+	return chirp, nil
+}
+func (dbSuper *DBSuper) activeRechirp(originalId, userId int) (Chirp, bool) {
+	for _, id := range dbSuper.rechirps[originalId] {
+		if chirp, err := dbSuper.getChirp(id); err == nil && chirp.AuthorId == userId {
+			return chirp, true
+		}
+	}
+	return Chirp{}, false
+}
+func (dbSuper *DBSuper) rechirp(id, authorId int) (walEntry, error) {
+	original, err := dbSuper.original(id)
+	if err != nil {
+		return walEntry{}, err
+	}
+	if _, ok := dbSuper.activeRechirp(original.Id, authorId); ok {
+		return walEntry{}, ErrAlreadyRechirped
+	}
+	entry, err := dbSuper.createChirp("", authorId, 0, 0)
+	if err != nil {
+		return walEntry{}, err
+	}
+	entry.Chirp.RechirpOf = &original.Id
+	return entry, nil
+}
+func (dbSuper *DBSuper) unrechirp(id, authorId int) (walEntry, error) {
+	original, err := dbSuper.original(id)
+	if err != nil {
+		return walEntry{}, err
+	}
+	rechirp, ok := dbSuper.activeRechirp(original.Id, authorId)
+	if !ok {
+		return walEntry{}, errNotRechirped
+	}
+	now := time.Now().UTC()
+	return walEntry{Op: opChirpTrashed, Id: rechirp.Id, Time: &now}, nil
+}
+func (dbSuper *DBSuper) indexAmplified(chirp Chirp) {
+	if chirp.RechirpOf != nil {
+		dbSuper.rechirps[*chirp.RechirpOf] = append(dbSuper.rechirps[*chirp.RechirpOf], chirp.Id)
+	}
+	if chirp.QuoteOf != nil {
+		dbSuper.quotes[*chirp.QuoteOf] = append(dbSuper.quotes[*chirp.QuoteOf], chirp.Id)
+	}
+}
+func (dbSuper *DBSuper) unindexAmplified(chirp Chirp) {
+	if chirp.RechirpOf != nil {
+		dbSuper.rechirps[*chirp.RechirpOf] = without(dbSuper.rechirps[*chirp.RechirpOf], chirp.Id)
+	}
+	if chirp.QuoteOf != nil {
+		dbSuper.quotes[*chirp.QuoteOf] = without(dbSuper.quotes[*chirp.QuoteOf], chirp.Id)
+	}
+}
+func without(ids []int, id int) []int {
+	kept := ids[:0]
+	for _, other := range ids {
+		if other != id {
+			kept = append(kept, other)
+		}
+	}
+	return kept
+}
+func (dbSuper *DBSuper) liveCount(ids []int) int {
+	n := 0
+	for _, id := range ids {
+		if dbSuper.DBStructure.Chirps[id].DeletedAt == nil {
+			n++
+		}
+	}
+	return n
+}
+func (dbSuper *DBSuper) chirpStats(ids []int, userId int) map[int]ChirpStats {
+	stats := make(map[int]ChirpStats, len(ids))
+	for _, id := range ids {
+		stats[id] = ChirpStats{
+			Likes:    len(dbSuper.Likes[id]),
+			Liked:    dbSuper.isLiked(id, userId),
+			Rechirps: dbSuper.liveCount(dbSuper.rechirps[id]),
+			Quotes:   dbSuper.liveCount(dbSuper.quotes[id]),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRechirpsAndQuotes(t *testing.T) {
+	openStores(t, allStores, func(t *testing.T, db Store) {
+		if _, err := db.CreateUser("bob@example.com", "hunter22", "bob"); err != nil {
+			t.Fatal(err)
+		}
+		const alice, bob = 1, 2
+		original, err := db.CreateChirp("original", alice, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := func(step string, want ChirpStats) {
+			t.Helper()
+			got, err := db.ChirpStats([]int{original.Id}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got[original.Id] != want {
+				t.Errorf("%s: stats = %+v, want %+v", step, got[original.Id], want)
+			}
+		}
+
+		rechirp, err := db.Rechirp(original.Id, bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rechirp.RechirpOf == nil || *rechirp.RechirpOf != original.Id || rechirp.AuthorId != bob {
+			t.Errorf("rechirp = %+v, want bob reposting %d", rechirp, original.Id)
+		}
+		if _, err := db.Rechirp(original.Id, bob); !errors.Is(err, ErrAlreadyRechirped) {
+			t.Errorf("rechirping twice = %v, want ErrAlreadyRechirped", err)
+		}
+		if _, err := db.Rechirp(rechirp.Id, bob); !errors.Is(err, ErrAlreadyRechirped) {
+			t.Errorf("rechirping your own rechirp = %v, want ErrAlreadyRechirped", err)
+		}
+		if _, err := db.UpdateChirp(rechirp.Id, bob, "edited"); !errors.Is(err, ErrRechirpEdit) {
+			t.Errorf("editing a rechirp = %v, want ErrRechirpEdit", err)
+		}
+		if _, err := db.Rechirp(rechirp.Id, alice); err != nil {
+			t.Errorf("rechirping a rechirp: %v", err)
+		}
+		quote, err := db.CreateChirp("look at this", bob, 0, original.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		quoteOfRechirp, err := db.CreateChirp("and this", bob, 0, rechirp.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quoteOfRechirp.QuoteOf == nil || *quoteOfRechirp.QuoteOf != original.Id {
+			t.Errorf("quote of a rechirp = %+v, want it to quote %d", quoteOfRechirp, original.Id)
+		}
+		stats("rechirped and quoted", ChirpStats{Rechirps: 2, Quotes: 2})
+
+		if err := db.Unrechirp(original.Id, bob); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.DeleteChirp(quoteOfRechirp.Id, bob); err != nil {
+			t.Fatal(err)
+		}
+		stats("unrechirped and a quote deleted", ChirpStats{Rechirps: 1, Quotes: 1})
+		if _, err := db.Rechirp(original.Id, bob); err != nil {
+			t.Errorf("rechirping again after unrechirping: %v", err)
+		}
+
+		if err := db.DeleteChirp(original.Id, alice); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Rechirp(original.Id, alice); !errors.Is(err, ErrOriginalNotFound) {
+			t.Errorf("rechirping a deleted chirp = %v, want ErrOriginalNotFound", err)
+		}
+		if _, err := db.Rechirp(rechirp.Id, alice); !errors.Is(err, ErrOriginalNotFound) {
+			t.Errorf("rechirping a rechirp of a deleted chirp = %v, want ErrOriginalNotFound", err)
+		}
+		if _, err := db.CreateChirp("quoting", bob, 0, original.Id); !errors.Is(err, ErrOriginalNotFound) {
+			t.Errorf("quoting a deleted chirp = %v, want ErrOriginalNotFound", err)
+		}
+
+		if _, err := db.PurgeChirps(time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		kept, err := db.GetChirp(quote.Id)
+		if err != nil {
+			t.Fatalf("quote of a purged chirp: %v", err)
+		}
+		if kept.QuoteOf == nil || *kept.QuoteOf != original.Id {
+			t.Errorf("quote of a purged chirp = %+v, want it to still point at %d", kept, original.Id)
+		}
+		if _, err := db.GetChirp(original.Id); !errors.Is(err, ErrChirpNotFound) {
+			t.Errorf("purged chirp = %v, want ErrChirpNotFound", err)
+		}
+	})
+}
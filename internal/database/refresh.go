@@ -0,0 +1,205 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var ErrInvalidRefreshToken = errors.New("Invalid refresh token")
+
+// Refresh tokens are opaque random strings, and only their SHA-256 is
+// stored. Each login starts a family; every refresh rotates the token,
+// marking the old one used and issuing a new one in the same family.
+// Presenting a used token means it was copied, so the whole family is
+// revoked.
+type RefreshToken struct {
+	Hash      string     `json:"hash"`
+	FamilyId  string     `json:"family_id"`
+	UserId    int        `json:"user_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// IssuedToken is a refresh token as handed to its user.
+type IssuedToken struct {
+	Token     string
+	UserId    int
+	FamilyId  string
+	ExpiresAt time.Time
+}
+
+// TokenReuseError reports a rotated refresh token presented again, after
+// its family has been revoked.
+type TokenReuseError struct {
+	UserId   int
+	FamilyId string
+}
+
+func (e *TokenReuseError) Error() string {
+	return "Refresh token reused, revoked its family"
+}
+
+// Unwrap makes a reused token an invalid one too.
+func (e *TokenReuseError) Unwrap() error {
+	return ErrInvalidRefreshToken
+}
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// newRefreshToken makes a token in familyId, or in a new family when
+// familyId is empty.
+func newRefreshToken(userId int, familyId string, ttl time.Duration) (IssuedToken, RefreshToken, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return IssuedToken{}, RefreshToken{}, err
+	}
+	if familyId == "" {
+		if familyId, err = randomString(16); err != nil {
+			return IssuedToken{}, RefreshToken{}, err
+		}
+	}
+	now := time.Now().UTC()
+	stored := RefreshToken{
+		Hash:      hashRefreshToken(token),
+		FamilyId:  familyId,
+		UserId:    userId,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	return IssuedToken{Token: token, UserId: userId, FamilyId: familyId, ExpiresAt: stored.ExpiresAt}, stored, nil
+}
+func (rt RefreshToken) usable(now time.Time) bool {
+	return rt.RevokedAt == nil && now.Before(rt.ExpiresAt)
+}
+
+// newSession starts the session of a login that was issued stored.
+func newSession(stored RefreshToken, client Client) Session {
+	session := Session{Id: stored.FamilyId, UserId: stored.UserId, CreatedAt: stored.CreatedAt}
+	return session.touch(client, stored.CreatedAt, stored.ExpiresAt)
+}
+func (dbSuper *DBSuper) issueRefreshToken(userId int, ttl time.Duration, client Client) (walEntry, IssuedToken, error) {
+	if _, ok := dbSuper.userById(userId); !ok {
+		return walEntry{}, IssuedToken{}, ErrUserNotFound
+	}
+	issued, stored, err := newRefreshToken(userId, "", ttl)
+	if err != nil {
+		return walEntry{}, IssuedToken{}, err
+	}
+	session := newSession(stored, client)
+	return walEntry{Op: opRefreshIssued, Refresh: &stored, Session: &session}, issued, nil
+}
+
+// rotateRefreshToken returns the entries to commit even when it fails, as
+// a reused token revokes its family.
+func (dbSuper *DBSuper) rotateRefreshToken(token string, ttl time.Duration, client Client) ([]walEntry, IssuedToken, error) {
+	now := time.Now().UTC()
+	rt, ok := dbSuper.RefreshTokens[hashRefreshToken(token)]
+	if !ok || !rt.usable(now) {
+		return nil, IssuedToken{}, ErrInvalidRefreshToken
+	}
+	if rt.RotatedAt != nil {
+		revoke := walEntry{Op: opRefreshRevoked, Token: rt.FamilyId, Time: &now}
+		return []walEntry{revoke}, IssuedToken{}, &TokenReuseError{UserId: rt.UserId, FamilyId: rt.FamilyId}
+	}
+	issued, stored, err := newRefreshToken(rt.UserId, rt.FamilyId, ttl)
+	if err != nil {
+		return nil, IssuedToken{}, err
+	}
+	entry := walEntry{Op: opRefreshIssued, Refresh: &stored}
+	if session, ok := dbSuper.Sessions[rt.FamilyId]; ok {
+		session = session.touch(client, now, stored.ExpiresAt)
+		entry.Session = &session
+	}
+	return []walEntry{
+		{Op: opRefreshRotated, Token: rt.Hash, Time: &now},
+		entry,
+	}, issued, nil
+}
+func (dbSuper *DBSuper) revokeRefreshToken(token string) (walEntry, error) {
+	rt, ok := dbSuper.RefreshTokens[hashRefreshToken(token)]
+	if !ok || rt.RevokedAt != nil {
+		return walEntry{}, ErrInvalidRefreshToken
+	}
+	now := time.Now().UTC()
+	return walEntry{Op: opRefreshRevoked, Token: rt.FamilyId, Time: &now}, nil
+}
+func (dbSuper *DBSuper) purgeRefreshTokens(before time.Time) []walEntry {
+	var entries []walEntry
+	for hash, rt := range dbSuper.RefreshTokens {
+		if rt.ExpiresAt.Before(before) {
+			entries = append(entries, walEntry{Op: opRefreshPurged, Token: hash})
+		}
+	}
+	return entries
+}
+func (dbSuper *DBSuper) applyRefresh(entry walEntry) {
+	switch entry.Op {
+	case opRefreshIssued:
+		rt := *entry.Refresh
+		dbSuper.RefreshTokens[rt.Hash] = rt
+		dbSuper.families[rt.FamilyId] = append(dbSuper.families[rt.FamilyId], rt.Hash)
+		if entry.Session != nil {
+			dbSuper.Sessions[entry.Session.Id] = *entry.Session
+		} else {
+			// Logged before sessions were recorded.
+			dbSuper.backfillSession(rt)
+		}
+	case opRefreshRotated:
+		if rt, ok := dbSuper.RefreshTokens[entry.Token]; ok {
+			rt.RotatedAt = entry.Time
+			dbSuper.RefreshTokens[entry.Token] = rt
+		}
+	case opRefreshRevoked:
+		for _, hash := range dbSuper.families[entry.Token] {
+			rt := dbSuper.RefreshTokens[hash]
+			if rt.RevokedAt == nil {
+				rt.RevokedAt = entry.Time
+				dbSuper.RefreshTokens[hash] = rt
+			}
+		}
+		if session, ok := dbSuper.Sessions[entry.Token]; ok && session.RevokedAt == nil {
+			session.RevokedAt = entry.Time
+			dbSuper.Sessions[entry.Token] = session
+		}
+	case opRefreshPurged:
+		rt, ok := dbSuper.RefreshTokens[entry.Token]
+		if !ok {
+			return
+		}
+		delete(dbSuper.RefreshTokens, entry.Token)
+		family := dbSuper.families[rt.FamilyId]
+		for i, hash := range family {
+			if hash == entry.Token {
+				family = append(family[:i], family[i+1:]...)
+				break
+			}
+		}
+		if len(family) == 0 {
+			delete(dbSuper.families, rt.FamilyId)
+			delete(dbSuper.Sessions, rt.FamilyId)
+		} else {
+			dbSuper.families[rt.FamilyId] = family
+		}
+	}
+}
+func (dbSuper *DBSuper) indexFamilies() {
+	dbSuper.families = map[string][]string{}
+	for hash, rt := range dbSuper.RefreshTokens {
+		dbSuper.families[rt.FamilyId] = append(dbSuper.families[rt.FamilyId], hash)
+	}
+}
@@ -0,0 +1,184 @@
+package database
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRefreshTokenReuse(t *testing.T) {
+	client := Client{IP: "192.0.2.1", UserAgent: "test"}
+
+	// Each case issues a family and returns the token to present and the
+	// newest token of the family, which reuse must revoke with the rest.
+	tests := []struct {
+		name      string
+		setup     func(t *testing.T, db Store, userId int) (present, newest IssuedToken)
+		wantErr   error
+		wantReuse bool // the error is also a *TokenReuseError
+	}{
+		{
+			name: "fresh token rotates",
+			setup: func(t *testing.T, db Store, userId int) (IssuedToken, IssuedToken) {
+				first := issue(t, db, userId, time.Hour)
+				return first, first
+			},
+		},
+		{
+			name: "rotated token presented again",
+			setup: func(t *testing.T, db Store, userId int) (IssuedToken, IssuedToken) {
+				first := issue(t, db, userId, time.Hour)
+				return first, rotate(t, db, first)
+			},
+			wantErr:   ErrInvalidRefreshToken,
+			wantReuse: true,
+		},
+		{
+			name: "older generation presented again",
+			setup: func(t *testing.T, db Store, userId int) (IssuedToken, IssuedToken) {
+				first := issue(t, db, userId, time.Hour)
+				return first, rotate(t, db, rotate(t, db, first))
+			},
+			wantErr:   ErrInvalidRefreshToken,
+			wantReuse: true,
+		},
+		{
+			name: "revoked token is invalid, not reused",
+			setup: func(t *testing.T, db Store, userId int) (IssuedToken, IssuedToken) {
+				first := issue(t, db, userId, time.Hour)
+				if err := db.RevokeRefreshToken(first.Token); err != nil {
+					t.Fatal(err)
+				}
+				return first, first
+			},
+			wantErr: ErrInvalidRefreshToken,
+		},
+		{
+			name: "expired token is invalid, not reused",
+			setup: func(t *testing.T, db Store, userId int) (IssuedToken, IssuedToken) {
+				first := issue(t, db, userId, -time.Minute)
+				return first, first
+			},
+			wantErr: ErrInvalidRefreshToken,
+		},
+		{
+			name: "unknown token",
+			setup: func(t *testing.T, db Store, userId int) (IssuedToken, IssuedToken) {
+				return IssuedToken{Token: "not-a-token"}, IssuedToken{}
+			},
+			wantErr: ErrInvalidRefreshToken,
+		},
+	}
+	for _, backend := range allStores {
+		t.Run(backend.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := backend.open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, err := db.CreateUser("alice@example.com", "hunter22", "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var revoked []IssuedToken
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					present, newest := tt.setup(t, db, user.Id)
+					_, err := db.RotateRefreshToken(present.Token, time.Hour, client)
+					if !errors.Is(err, tt.wantErr) {
+						t.Fatalf("rotate = %v, want %v", err, tt.wantErr)
+					}
+					var reuse *TokenReuseError
+					if got := errors.As(err, &reuse); got != tt.wantReuse {
+						t.Fatalf("rotate = %v, reported as reuse %v, want %v", err, got, tt.wantReuse)
+					}
+					if !tt.wantReuse {
+						return
+					}
+					if reuse.UserId != user.Id || reuse.FamilyId != present.FamilyId {
+						t.Errorf("reuse = %+v, want user %d family %s", reuse, user.Id, present.FamilyId)
+					}
+					if _, err := db.RotateRefreshToken(newest.Token, time.Hour, client); !errors.Is(err, ErrInvalidRefreshToken) {
+						t.Errorf("newest token of the family after reuse = %v, want it revoked", err)
+					}
+					if session, err := db.GetSession(present.FamilyId); err != nil || session.RevokedAt == nil {
+						t.Errorf("session after reuse = %+v, %v, want it revoked", session, err)
+					}
+					revoked = append(revoked, newest)
+				})
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if backend.name == "memory" {
+				return
+			}
+			if db, err = backend.open(dir); err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for _, token := range revoked {
+				if _, err := db.RotateRefreshToken(token.Token, time.Hour, client); !errors.Is(err, ErrInvalidRefreshToken) {
+					t.Errorf("family revoked for reuse after reopening = %v, want it still revoked", err)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentRotation(t *testing.T) {
+	const racers = 8
+	openStores(t, allStores, func(t *testing.T, db Store) {
+		first := issue(t, db, 1, time.Hour)
+		var wg sync.WaitGroup
+		issued := make([]IssuedToken, racers)
+		errs := make([]error, racers)
+		start := make(chan struct{})
+		for i := range racers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				issued[i], errs[i] = db.RotateRefreshToken(first.Token, time.Hour, Client{})
+			}()
+		}
+		close(start)
+		wg.Wait()
+		var winners []IssuedToken
+		for i, err := range errs {
+			if err == nil {
+				winners = append(winners, issued[i])
+				continue
+			}
+			if !errors.Is(err, ErrInvalidRefreshToken) {
+				t.Errorf("losing rotation = %v, want ErrInvalidRefreshToken", err)
+			}
+		}
+		if len(winners) != 1 {
+			t.Fatalf("%d rotations succeeded, want 1", len(winners))
+		}
+		// Every loser presented a rotated token, so the family is revoked.
+		if _, err := db.RotateRefreshToken(winners[0].Token, time.Hour, Client{}); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("winning token after the race = %v, want it revoked as reuse", err)
+		}
+	})
+}
+
+func issue(t *testing.T, db Store, userId int, ttl time.Duration) IssuedToken {
+	t.Helper()
+	issued, err := db.IssueRefreshToken(userId, ttl, Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issued
+}
+
+func rotate(t *testing.T, db Store, token IssuedToken) IssuedToken {
+	t.Helper()
+	issued, err := db.RotateRefreshToken(token.Token, time.Hour, Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issued
+}
@@ -0,0 +1,193 @@
+package database
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var ErrEmptySearch = errors.New("Search query has no terms")
+
+// SearchQuery is a full-text query over chirp bodies. Text holds words,
+// "quoted phrases" and prefix terms ending in *, all of which must match.
+type SearchQuery struct {
+	Text      string
+	ByRecency bool
+	Limit     int
+}
+
+// A searchClause is a single word or a phrase whose last term may be a
+// prefix.
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+func parseSearchQuery(text string) ([]searchClause, error) {
+	var clauses []searchClause
+	for i, part := range strings.Split(text, `"`) {
+		if i%2 == 1 {
+			prefix := strings.HasSuffix(strings.TrimSpace(part), "*")
+			if terms := tokenize(part); len(terms) > 0 {
+				clauses = append(clauses, searchClause{terms: terms, prefix: prefix})
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			prefix := strings.HasSuffix(word, "*")
+			for _, term := range tokenize(word) {
+				clauses = append(clauses, searchClause{terms: []string{term}})
+			}
+			if prefix && len(clauses) > 0 {
+				clauses[len(clauses)-1].prefix = true
+			}
+		}
+	}
+	if len(clauses) == 0 {
+		return nil, ErrEmptySearch
+	}
+	return clauses, nil
+}
+
+// searchIndex is an inverted index from term to the positions it takes in
+// each chirp. Deleted chirps are kept out of it.
+type searchIndex struct {
+	postings map[string]map[int][]int
+	docTerms map[int][]string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: map[string]map[int][]int{},
+		docTerms: map[int][]string{},
+	}
+}
+func (idx *searchIndex) add(id int, body string) {
+	idx.remove(id)
+	var terms []string
+	for pos, term := range tokenize(body) {
+		docs, ok := idx.postings[term]
+		if !ok {
+			docs = map[int][]int{}
+			idx.postings[term] = docs
+		}
+		if _, ok := docs[id]; !ok {
+			terms = append(terms, term)
+		}
+		docs[id] = append(docs[id], pos)
+	}
+	idx.docTerms[id] = terms
+}
+func (idx *searchIndex) remove(id int) {
+	for _, term := range idx.docTerms[id] {
+		delete(idx.postings[term], id)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	delete(idx.docTerms, id)
+}
+func (idx *searchIndex) expand(term string, prefix bool) []string {
+	if !prefix {
+		return []string{term}
+	}
+	var terms []string
+	for t := range idx.postings {
+		if strings.HasPrefix(t, term) {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// occurrences counts how often the clause appears in each chirp.
+func (idx *searchIndex) occurrences(clause searchClause) map[int]int {
+	slots := make([]map[int]map[int]bool, len(clause.terms))
+	for i, term := range clause.terms {
+		slots[i] = map[int]map[int]bool{}
+		for _, t := range idx.expand(term, clause.prefix && i == len(clause.terms)-1) {
+			for id, positions := range idx.postings[t] {
+				if slots[i][id] == nil {
+					slots[i][id] = map[int]bool{}
+				}
+				for _, pos := range positions {
+					slots[i][id][pos] = true
+				}
+			}
+		}
+	}
+	counts := map[int]int{}
+	for id, starts := range slots[0] {
+		for start := range starts {
+			match := true
+			for i := 1; i < len(slots) && match; i++ {
+				match = slots[i][id][start+i]
+			}
+			if match {
+				counts[id]++
+			}
+		}
+	}
+	return counts
+}
+
+// search scores every chirp matching all clauses with a tf-idf sum.
+func (idx *searchIndex) search(clauses []searchClause) map[int]float64 {
+	scores := map[int]float64{}
+	total := float64(len(idx.docTerms))
+	for i, clause := range clauses {
+		counts := idx.occurrences(clause)
+		idf := math.Log(1 + total/float64(len(counts)+1))
+		next := map[int]float64{}
+		for id, n := range counts {
+			if _, ok := scores[id]; i > 0 && !ok {
+				continue
+			}
+			next[id] = scores[id] + (1+math.Log(float64(n)))*idf
+		}
+		scores = next
+	}
+	return scores
+}
+func (dbSuper *DBSuper) searchChirps(q SearchQuery) ([]Chirp, error) {
+	clauses, err := parseSearchQuery(q.Text)
+	if err != nil {
+		return nil, err
+	}
+	scores := dbSuper.search.search(clauses)
+	chirps := make([]Chirp, 0, len(scores))
+	for id := range scores {
+		chirps = append(chirps, dbSuper.DBStructure.Chirps[id])
+	}
+	sort.Slice(chirps, func(i, j int) bool {
+		a, b := chirps[i], chirps[j]
+		if !q.ByRecency && scores[a.Id] != scores[b.Id] {
+			return scores[a.Id] > scores[b.Id]
+		}
+		return a.Id > b.Id
+	})
+	if q.Limit > 0 && len(chirps) > q.Limit {
+		chirps = chirps[:q.Limit]
+	}
+	return chirps, nil
+}
+
+// ftsMatch renders clauses as an FTS5 MATCH expression with every term
+// quoted, so user input can't inject FTS5 operators.
+func ftsMatch(clauses []searchClause) string {
+	parts := make([]string, len(clauses))
+	for i, clause := range clauses {
+		parts[i] = `"` + strings.Join(clause.terms, " ") + `"`
+		if clause.prefix {
+			parts[i] += "*"
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSearchChirps(t *testing.T) {
+	openStores(t, allStores, func(t *testing.T, db Store) {
+		for _, body := range []string{
+			"Cats are great pets",
+			"dogs chase cats",
+			"cats cats cats",
+			"a catalog of birds",
+			"the great outdoors or indoors",
+			"near the body of water",
+			"deleted cats",
+			"an old body",
+		} {
+			if _, err := db.CreateChirp(body, 1, 0, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.DeleteChirp(7, 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.UpdateChirp(8, 1, "now about hamsters"); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name      string
+			text      string
+			byRecency bool
+			want      string
+		}{
+			{"ranked by how often the term appears", "cats", false, "3,2,1"},
+			{"case folded", "CATS", false, "3,2,1"},
+			{"prefix", "cat*", true, "4,3,2,1"},
+			{"all terms must match", "great pets", false, "1"},
+			{"phrase", `"chase cats"`, false, "2"},
+			{"phrase out of order", `"cats chase"`, false, ""},
+			{"phrase with a prefix", `"dogs cha*"`, false, "2"},
+			{"minus is not negation", "cats -dogs", false, "2"},
+			{"OR is a plain word", "outdoors OR indoors", false, "5"},
+			{"OR is not a union", "cats OR dogs", false, ""},
+			{"NEAR is a plain word", "NEAR(body water)", false, "6"},
+			{"column filters are plain words", "body:water", false, "6"},
+			{"unbalanced quote", `"great`, true, "5,1"},
+			{"apostrophe", "cats'", true, "3,2,1"},
+			{"deleted chirps are left out", "deleted", false, ""},
+			{"edited text is found", "hamsters", false, "8"},
+			{"text replaced by an edit is not", "old", false, ""},
+		}
+		for _, tt := range tests {
+			chirps, err := db.SearchChirps(SearchQuery{Text: tt.text, ByRecency: tt.byRecency})
+			if err != nil {
+				t.Errorf("%s: search %q: %v", tt.name, tt.text, err)
+				continue
+			}
+			if got := ids(chirps); got != tt.want {
+				t.Errorf("%s: search %q = %s, want %s", tt.name, tt.text, got, tt.want)
+			}
+		}
+		if chirps, err := db.SearchChirps(SearchQuery{Text: "cats", Limit: 2}); err != nil || ids(chirps) != "3,2" {
+			t.Errorf("search limited to 2 = %s, %v, want 3,2", ids(chirps), err)
+		}
+		for _, text := range []string{"", "***", `""`, "-"} {
+			if _, err := db.SearchChirps(SearchQuery{Text: text}); !errors.Is(err, ErrEmptySearch) {
+				t.Errorf("search %q = %v, want ErrEmptySearch", text, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrSessionNotFound = errors.New("Session not found")
+
+// Session is a login, as seen by its user. It shares its id with the family
+// of refresh tokens the login started, so it lasts as long as they do and
+// revoking one revokes the other.
+type Session struct {
+	Id         string     `json:"id"`
+	UserId     int        `json:"user_id"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Client is where a login or refresh came from.
+type Client struct {
+	IP        string
+	UserAgent string
+}
+
+func (session Session) active(now time.Time) bool {
+	return session.RevokedAt == nil && now.Before(session.ExpiresAt)
+}
+
+// touch records a use of the session by client, refreshed until expiresAt.
+func (session Session) touch(client Client, now, expiresAt time.Time) Session {
+	session.IP = client.IP
+	session.UserAgent = client.UserAgent
+	session.LastUsedAt = now
+	session.ExpiresAt = expiresAt
+	return session
+}
+
+// sessionsOf rebuilds sessions from refresh tokens issued before sessions
+// were recorded. Their IP and user agent are unknown.
+func sessionsOf(tokens map[string]RefreshToken) map[string]Session {
+	sessions := map[string]Session{}
+	for _, rt := range tokens {
+		session, ok := sessions[rt.FamilyId]
+		if !ok {
+			session = Session{Id: rt.FamilyId, UserId: rt.UserId, CreatedAt: rt.CreatedAt}
+		}
+		if rt.CreatedAt.Before(session.CreatedAt) {
+			session.CreatedAt = rt.CreatedAt
+		}
+		if rt.CreatedAt.After(session.LastUsedAt) {
+			session.LastUsedAt = rt.CreatedAt
+		}
+		if rt.ExpiresAt.After(session.ExpiresAt) {
+			session.ExpiresAt = rt.ExpiresAt
+		}
+		if rt.RevokedAt != nil {
+			session.RevokedAt = rt.RevokedAt
+		}
+		sessions[rt.FamilyId] = session
+	}
+	return sessions
+}
+
+// backfillSession records rt, issued before sessions were, on the
+// session of its family.
+func (dbSuper *DBSuper) backfillSession(rt RefreshToken) {
+	session, ok := dbSuper.Sessions[rt.FamilyId]
+	if !ok {
+		session = Session{Id: rt.FamilyId, UserId: rt.UserId, CreatedAt: rt.CreatedAt}
+	}
+	session.LastUsedAt = rt.CreatedAt
+	session.ExpiresAt = rt.ExpiresAt
+	dbSuper.Sessions[rt.FamilyId] = session
+}
+
+// sortSessions puts the most recently used sessions first.
+func sortSessions(sessions []Session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+		}
+		return sessions[i].Id < sessions[j].Id
+	})
+}
+func (dbSuper *DBSuper) listSessions(userId int) []Session {
+	now := time.Now()
+	sessions := []Session{}
+	for _, session := range dbSuper.Sessions {
+		if session.UserId == userId && session.active(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	sortSessions(sessions)
+	return sessions
+}
+func (dbSuper *DBSuper) getSession(id string) (Session, error) {
+	session, ok := dbSuper.Sessions[id]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+// revokeSession revokes a session of userId. Other users' sessions are
+// reported as not found.
+func (dbSuper *DBSuper) revokeSession(userId int, id string) (walEntry, error) {
+	session, ok := dbSuper.Sessions[id]
+	now := time.Now().UTC()
+	if !ok || session.UserId != userId || !session.active(now) {
+		return walEntry{}, ErrSessionNotFound
+	}
+	return walEntry{Op: opRefreshRevoked, Token: id, Time: &now}, nil
+}
+func (dbSuper *DBSuper) revokeOtherSessions(userId int, keep string) []walEntry {
+	now := time.Now().UTC()
+	var entries []walEntry
+	for id, session := range dbSuper.Sessions {
+		if id != keep && session.UserId == userId && session.active(now) {
+			entries = append(entries, walEntry{Op: opRefreshRevoked, Token: id, Time: &now})
+		}
+	}
+	return entries
+}
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	openStores(t, allStores, func(t *testing.T, db Store) {
+		if _, err := db.CreateUser("bob@example.com", "hunter22", "bob"); err != nil {
+			t.Fatal(err)
+		}
+		const alice, bob = 1, 2
+		phone := issue(t, db, alice, time.Hour)
+		laptop := issue(t, db, alice, time.Hour)
+		tablet := issue(t, db, alice, time.Hour)
+		bobs := issue(t, db, bob, time.Hour)
+		listed := func(step string, userId int, want ...IssuedToken) {
+			t.Helper()
+			sessions, err := db.ListSessions(userId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]bool{}
+			for _, session := range sessions {
+				if session.UserId != userId {
+					t.Errorf("%s: sessions of %d list %+v", step, userId, session)
+				}
+				got[session.Id] = true
+			}
+			if len(got) != len(want) {
+				t.Errorf("%s: %d has %d sessions, want %d", step, userId, len(got), len(want))
+			}
+			for _, token := range want {
+				if !got[token.FamilyId] {
+					t.Errorf("%s: session %s of %d isn't listed", step, token.FamilyId, userId)
+				}
+			}
+		}
+		listed("logged in", alice, phone, laptop, tablet)
+		listed("logged in", bob, bobs)
+
+		if err := db.RevokeSession(bob, phone.FamilyId); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("revoking another user's session = %v, want ErrSessionNotFound", err)
+		}
+		if err := db.RevokeSession(alice, "no-such-session"); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("revoking a missing session = %v, want ErrSessionNotFound", err)
+		}
+		if err := db.RevokeSession(alice, phone.FamilyId); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.RotateRefreshToken(phone.Token, time.Hour, Client{}); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("refreshing a revoked session = %v, want ErrInvalidRefreshToken", err)
+		}
+		if session, err := db.GetSession(phone.FamilyId); err != nil || session.RevokedAt == nil {
+			t.Errorf("revoked session = %+v, %v, want it revoked", session, err)
+		}
+		listed("one revoked", alice, laptop, tablet)
+
+		rotated := rotate(t, db, laptop)
+		n, err := db.RevokeOtherSessions(alice, rotated.FamilyId)
+		if err != nil || n != 1 {
+			t.Errorf("revoking other sessions = %d, %v, want 1", n, err)
+		}
+		if _, err := db.RotateRefreshToken(tablet.Token, time.Hour, Client{}); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("refreshing another revoked session = %v, want ErrInvalidRefreshToken", err)
+		}
+		rotate(t, db, rotated)
+		listed("others revoked", alice, laptop)
+		listed("others revoked", bob, bobs)
+	})
+}
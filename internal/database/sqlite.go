@@ -0,0 +1,1095 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	_ "modernc.org/sqlite"
+)
+
+type SQLiteDB struct {
+	db *sql.DB
+}
+
+func openSQLite(path string) (*sql.DB, error) {
+	return sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+}
+func NewSQLiteDb(path string) (*SQLiteDB, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := migrateSQLite(db, false)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, name := range applied {
+		log.Printf("Migrated %s to schema version %s", path, name)
+	}
+	return &SQLiteDB{db: db}, nil
+}
+func (s *SQLiteDB) Close() error {
+	return s.db.Close()
+}
+
+const chirpColumns = `id, body, author_id, in_reply_to, conversation_id, rechirp_of, quote_of, entities, created_at, updated_at, deleted_at`
+const qualifiedChirpColumns = `chirps.id, chirps.body, chirps.author_id, chirps.in_reply_to, chirps.conversation_id, chirps.rechirp_of, chirps.quote_of, chirps.entities, chirps.created_at, chirps.updated_at, chirps.deleted_at`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanChirp(row scanner) (Chirp, error) {
+	var chirp Chirp
+	var createdAt, updatedAt int64
+	var inReplyTo, rechirpOf, quoteOf, deletedAt sql.NullInt64
+	var entities string
+	if err := row.Scan(&chirp.Id, &chirp.Body, &chirp.AuthorId, &inReplyTo, &chirp.ConversationId, &rechirpOf, &quoteOf, &entities, &createdAt, &updatedAt, &deletedAt); err != nil {
+		return Chirp{}, err
+	}
+	if err := json.Unmarshal([]byte(entities), &chirp.Entities); err != nil {
+		return Chirp{}, err
+	}
+	chirp.InReplyTo = nullableId(inReplyTo)
+	chirp.RechirpOf = nullableId(rechirpOf)
+	chirp.QuoteOf = nullableId(quoteOf)
+	chirp.CreatedAt = time.UnixMilli(createdAt).UTC()
+	chirp.UpdatedAt = time.UnixMilli(updatedAt).UTC()
+	chirp.DeletedAt = fromUnixMilli(deletedAt)
+	return chirp, nil
+}
+func nullableId(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	id := int(n.Int64)
+	return &id
+}
+func nullId(id *int) sql.NullInt64 {
+	if id == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(*id), Valid: true}
+}
+func (s *SQLiteDB) CreateChirp(body string, authorId, inReplyTo, quoteOf int) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+	entities, err := parseEntities(body, handleResolver(tx))
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp := Chirp{Body: body, AuthorId: authorId, Entities: entities}
+	if inReplyTo != 0 {
+		err := tx.QueryRow(`SELECT conversation_id FROM chirps WHERE id = ? AND deleted_at IS NULL`, inReplyTo).Scan(&chirp.ConversationId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return Chirp{}, ErrParentNotFound
+		}
+		if err != nil {
+			return Chirp{}, err
+		}
+		chirp.InReplyTo = &inReplyTo
+	}
+	if quoteOf != 0 {
+		original, err := originalId(tx, quoteOf)
+		if err != nil {
+			return Chirp{}, err
+		}
+		chirp.QuoteOf = &original
+	}
+	if err := insertChirp(tx, &chirp); err != nil {
+		return Chirp{}, err
+	}
+	return chirp, tx.Commit()
+}
+
+// insertChirp stores a new chirp and fills in its id and timestamps. A
+// chirp that doesn't reply to anything starts its own conversation.
+func insertChirp(tx *sql.Tx, chirp *Chirp) error {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	res, err := tx.Exec(`INSERT INTO chirps (body, author_id, in_reply_to, conversation_id, rechirp_of, quote_of, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		chirp.Body, chirp.AuthorId, nullId(chirp.InReplyTo), chirp.ConversationId, nullId(chirp.RechirpOf), nullId(chirp.QuoteOf), unixMilli(now), unixMilli(now))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	chirp.Id = int(id)
+	if chirp.InReplyTo == nil {
+		chirp.ConversationId = chirp.Id
+		if _, err := tx.Exec(`UPDATE chirps SET conversation_id = id WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	chirp.CreatedAt = now
+	chirp.UpdatedAt = now
+	return storeEntities(tx, chirp.Id, chirp.Entities)
+}
+
+// storeEntities writes a chirp's entities and the hashtag and mention
+// rows that index it, replacing any it had.
+func storeEntities(tx *sql.Tx, chirpId int, entities Entities) error {
+	dat, err := json.Marshal(entities)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE chirps SET entities = ? WHERE id = ?`, string(dat), chirpId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM chirp_hashtags WHERE chirp_id = ?`, chirpId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM chirp_mentions WHERE chirp_id = ?`, chirpId); err != nil {
+		return err
+	}
+	for _, tag := range entities.tags() {
+		if _, err := tx.Exec(`INSERT INTO chirp_hashtags (chirp_id, tag) VALUES (?, ?)`, chirpId, tag); err != nil {
+			return err
+		}
+	}
+	for _, userId := range entities.mentioned() {
+		if _, err := tx.Exec(`INSERT INTO chirp_mentions (chirp_id, user_id) VALUES (?, ?)`, chirpId, userId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func handleResolver(tx *sql.Tx) func(handle string) (int, error) {
+	return func(handle string) (int, error) {
+		var id int
+		err := tx.QueryRow(`SELECT id FROM users WHERE handle = ? COLLATE NOCASE`, handle).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrUserNotFound
+		}
+		return id, err
+	}
+}
+func emailTaken(tx *sql.Tx) func(email string) (bool, error) {
+	return func(email string) (bool, error) {
+		var taken bool
+		err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)`, email).Scan(&taken)
+		return taken, err
+	}
+}
+func handleTaken(tx *sql.Tx) func(handle string) (bool, error) {
+	return func(handle string) (bool, error) {
+		var taken bool
+		err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE handle = ? COLLATE NOCASE)`, handle).Scan(&taken)
+		return taken, err
+	}
+}
+
+// rehandleDigitsSQLite renames users whose handle is all digits, as
+// those are read as user ids.
+func rehandleDigitsSQLite(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, handle FROM users WHERE handle != '' AND handle NOT GLOB '*[^0-9]*' ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	var users []UserInternal
+	for rows.Next() {
+		var user UserInternal
+		if err := rows.Scan(&user.Id, &user.Handle); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, user := range users {
+		handle, err := freeHandle(user.Handle, handleTaken(tx))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE users SET handle = ? WHERE id = ?`, handle, user.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillEntitiesSQLite gives existing users handles and parses the
+// entities out of existing chirps once they can resolve.
+func backfillEntitiesSQLite(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, email FROM users WHERE handle IS NULL ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	var users []UserInternal
+	for rows.Next() {
+		var user UserInternal
+		if err := rows.Scan(&user.Id, &user.Email); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, user := range users {
+		handle, err := handleFromEmail(user.Email, handleTaken(tx))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE users SET handle = ? WHERE id = ?`, handle, user.Id); err != nil {
+			return err
+		}
+	}
+	rows, err = tx.Query(`SELECT id, body FROM chirps WHERE body != ''`)
+	if err != nil {
+		return err
+	}
+	var chirps []Chirp
+	for rows.Next() {
+		var chirp Chirp
+		if err := rows.Scan(&chirp.Id, &chirp.Body); err != nil {
+			rows.Close()
+			return err
+		}
+		chirps = append(chirps, chirp)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, chirp := range chirps {
+		entities, err := parseEntities(chirp.Body, handleResolver(tx))
+		if err != nil {
+			return err
+		}
+		if err := storeEntities(tx, chirp.Id, entities); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// originalId resolves id to the chirp being amplified, following a
+// rechirp to the chirp it reposts.
+func originalId(tx *sql.Tx, id int) (int, error) {
+	var original int
+	err := tx.QueryRow(`SELECT original.id FROM chirps JOIN chirps original ON original.id = COALESCE(chirps.rechirp_of, chirps.id)
+WHERE chirps.id = ? AND chirps.deleted_at IS NULL AND original.deleted_at IS NULL`, id).Scan(&original)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrOriginalNotFound
+	}
+	return original, err
+}
+func activeRechirpId(tx *sql.Tx, originalId, userId int) (int, error) {
+	var id int
+	err := tx.QueryRow(`SELECT id FROM chirps WHERE rechirp_of = ? AND author_id = ? AND deleted_at IS NULL`, originalId, userId).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errNotRechirped
+	}
+	return id, err
+}
+func (s *SQLiteDB) Rechirp(id, authorId int) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+	original, err := originalId(tx, id)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if _, err := activeRechirpId(tx, original, authorId); !errors.Is(err, errNotRechirped) {
+		if err == nil {
+			err = ErrAlreadyRechirped
+		}
+		return Chirp{}, err
+	}
+	chirp := Chirp{AuthorId: authorId, RechirpOf: &original}
+	if err := insertChirp(tx, &chirp); err != nil {
+		return Chirp{}, err
+	}
+	return chirp, tx.Commit()
+}
+func (s *SQLiteDB) Unrechirp(id, authorId int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	original, err := originalId(tx, id)
+	if err != nil {
+		return err
+	}
+	rechirp, err := activeRechirpId(tx, original, authorId)
+	if errors.Is(err, errNotRechirped) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE chirps SET deleted_at = ? WHERE id = ?`, unixMilli(time.Now()), rechirp); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM likes WHERE chirp_id = ?`, rechirp); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+func (s *SQLiteDB) GetChirps(q ChirpQuery) ([]Chirp, error) {
+	query := `SELECT ` + chirpColumns + ` FROM chirps WHERE deleted_at IS NULL`
+	var args []any
+	if q.AuthorId != 0 {
+		query += ` AND author_id = ?`
+		args = append(args, q.AuthorId)
+	}
+	if q.FollowedBy != 0 {
+		query += ` AND author_id IN (SELECT followee_id FROM follows WHERE follower_id = ?)`
+		args = append(args, q.FollowedBy)
+	}
+	if q.Hashtag != "" {
+		query += ` AND id IN (SELECT chirp_id FROM chirp_hashtags WHERE tag = ?)`
+		args = append(args, HashtagKey(q.Hashtag))
+	}
+	if q.MentionOf != 0 {
+		query += ` AND id IN (SELECT chirp_id FROM chirp_mentions WHERE user_id = ?)`
+		args = append(args, q.MentionOf)
+	}
+	if !q.Since.IsZero() {
+		query += ` AND created_at >= ?`
+		args = append(args, unixMilli(q.Since))
+	}
+	if !q.Until.IsZero() {
+		query += ` AND created_at < ?`
+		args = append(args, unixMilli(q.Until))
+	}
+	order := `ASC`
+	if q.Desc {
+		order = `DESC`
+	}
+	if q.After != 0 {
+		if q.Desc {
+			query += ` AND id < ?`
+		} else {
+			query += ` AND id > ?`
+		}
+		args = append(args, q.After)
+	}
+	query += ` ORDER BY id ` + order
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+	return s.queryChirps(query, args...)
+}
+func (s *SQLiteDB) SearchChirps(q SearchQuery) ([]Chirp, error) {
+	clauses, err := parseSearchQuery(q.Text)
+	if err != nil {
+		return nil, err
+	}
+	order := `bm25(chirps_fts), chirps.id DESC`
+	if q.ByRecency {
+		order = `chirps.id DESC`
+	}
+	query := `SELECT ` + qualifiedChirpColumns + ` FROM chirps_fts JOIN chirps ON chirps.id = chirps_fts.rowid
+WHERE chirps_fts MATCH ? AND chirps.deleted_at IS NULL ORDER BY ` + order
+	args := []any{ftsMatch(clauses)}
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+	return s.queryChirps(query, args...)
+}
+func (s *SQLiteDB) queryChirps(query string, args ...any) ([]Chirp, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return nil, err
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, rows.Err()
+}
+func (s *SQLiteDB) GetChirp(id int) (Chirp, error) {
+	chirp, err := scanChirp(s.db.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ? AND deleted_at IS NULL`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+func (s *SQLiteDB) GetThread(id int) (Thread, error) {
+	var conversationId int
+	err := s.db.QueryRow(`SELECT conversation_id FROM chirps WHERE id = ?`, id).Scan(&conversationId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Thread{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Thread{}, err
+	}
+	conversation, err := s.queryChirps(`SELECT `+chirpColumns+` FROM chirps WHERE conversation_id = ? ORDER BY id`, conversationId)
+	if err != nil {
+		return Thread{}, err
+	}
+	return buildThread(id, conversation)
+}
+func (s *SQLiteDB) UpdateChirp(id, authorId int, body string) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+	chirp, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ? AND deleted_at IS NULL`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.AuthorId != authorId {
+		return Chirp{}, ErrIdMismatch
+	}
+	if chirp.RechirpOf != nil {
+		return Chirp{}, ErrRechirpEdit
+	}
+	entities, err := parseEntities(body, handleResolver(tx))
+	if err != nil {
+		return Chirp{}, err
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if _, err := tx.Exec(`INSERT INTO chirp_revisions (chirp_id, body, created_at) VALUES (?, ?, ?)`, id, chirp.Body, unixMilli(chirp.UpdatedAt)); err != nil {
+		return Chirp{}, err
+	}
+	if _, err := tx.Exec(`UPDATE chirps SET body = ?, updated_at = ? WHERE id = ?`, body, unixMilli(now), id); err != nil {
+		return Chirp{}, err
+	}
+	if err := storeEntities(tx, id, entities); err != nil {
+		return Chirp{}, err
+	}
+	chirp.Body = body
+	chirp.Entities = entities
+	chirp.UpdatedAt = now
+	return chirp, tx.Commit()
+}
+func (s *SQLiteDB) GetChirpHistory(id int) ([]ChirpRevision, error) {
+	chirp, err := s.GetChirp(id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT body, created_at FROM chirp_revisions WHERE chirp_id = ? ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revisions := []ChirpRevision{}
+	for rows.Next() {
+		var revision ChirpRevision
+		var createdAt int64
+		if err := rows.Scan(&revision.Body, &createdAt); err != nil {
+			return nil, err
+		}
+		revision.CreatedAt = time.UnixMilli(createdAt).UTC()
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return append(revisions, ChirpRevision{Body: chirp.Body, CreatedAt: chirp.UpdatedAt}), nil
+}
+func (s *SQLiteDB) DeleteChirp(id, authorId int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var owner int
+	err = tx.QueryRow(`SELECT author_id FROM chirps WHERE id = ? AND deleted_at IS NULL`, id).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrChirpNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if owner != authorId {
+		return ErrIdMismatch
+	}
+	if _, err := tx.Exec(`UPDATE chirps SET deleted_at = ? WHERE id = ?`, unixMilli(time.Now()), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM likes WHERE chirp_id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+func (s *SQLiteDB) RestoreChirp(id, authorId int, window time.Duration) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+	chirp, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) || err == nil && chirp.DeletedAt == nil {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.AuthorId != authorId {
+		return Chirp{}, ErrIdMismatch
+	}
+	if time.Since(*chirp.DeletedAt) > window {
+		return Chirp{}, ErrRestoreExpired
+	}
+	if chirp.RechirpOf != nil {
+		if _, err := activeRechirpId(tx, *chirp.RechirpOf, authorId); !errors.Is(err, errNotRechirped) {
+			if err == nil {
+				err = ErrAlreadyRechirped
+			}
+			return Chirp{}, err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE chirps SET deleted_at = NULL WHERE id = ?`, id); err != nil {
+		return Chirp{}, err
+	}
+	chirp.DeletedAt = nil
+	return chirp, tx.Commit()
+}
+func (s *SQLiteDB) PurgeChirps(before time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM chirps WHERE deleted_at < ?`, unixMilli(before))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+func (s *SQLiteDB) CreateUser(email, password, handle string) (UserResponse, error) {
+	pWord, err := createUserPassword(password)
+	if err != nil {
+		return UserResponse{}, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return UserResponse{}, err
+	}
+	defer tx.Rollback()
+	exists, err := emailTaken(tx)(email)
+	if err != nil {
+		return UserResponse{}, err
+	}
+	if exists {
+		return UserResponse{}, ErrEmailTaken
+	}
+	if handle == "" {
+		if handle, err = handleFromEmail(email, handleTaken(tx)); err != nil {
+			return UserResponse{}, err
+		}
+	}
+	if !validHandle(handle) {
+		return UserResponse{}, ErrInvalidHandle
+	}
+	taken, err := handleTaken(tx)(handle)
+	if err != nil {
+		return UserResponse{}, err
+	}
+	if taken {
+		return UserResponse{}, ErrHandleTaken
+	}
+	res, err := tx.Exec(`INSERT INTO users (email, handle, password) VALUES (?, ?, ?)`, email, handle, pWord)
+	if err != nil {
+		return UserResponse{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return UserResponse{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return UserResponse{}, err
+	}
+	return UserResponse{
+		Id:     int(id),
+		Email:  email,
+		Handle: handle,
+	}, nil
+}
+
+const userColumns = `id, email, handle, display_name, bio, avatar_url, password`
+
+func scanUser(row scanner) (UserInternal, error) {
+	var user UserInternal
+	err := row.Scan(&user.Id, &user.Email, &user.Handle, &user.DisplayName, &user.Bio, &user.AvatarURL, &user.Password)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserInternal{}, ErrUserNotFound
+	}
+	return user, err
+}
+func (s *SQLiteDB) GetUser(id int) (UserResponse, error) {
+	user, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if err != nil {
+		return UserResponse{}, err
+	}
+	return userResponse(&user), nil
+}
+func (s *SQLiteDB) GetUserByHandle(handle string) (UserResponse, error) {
+	user, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE handle = ? COLLATE NOCASE`, handle))
+	if err != nil {
+		return UserResponse{}, err
+	}
+	return userResponse(&user), nil
+}
+func (s *SQLiteDB) GetProfile(id int) (Profile, error) {
+	var profile Profile
+	err := s.db.QueryRow(`SELECT id, handle, display_name, bio, avatar_url,
+	(SELECT COUNT(*) FROM chirps WHERE author_id = users.id AND deleted_at IS NULL),
+	(SELECT COUNT(*) FROM follows WHERE followee_id = users.id),
+	(SELECT COUNT(*) FROM follows WHERE follower_id = users.id)
+FROM users WHERE id = ?`, id).Scan(&profile.Id, &profile.Handle, &profile.DisplayName, &profile.Bio, &profile.AvatarURL,
+		&profile.ChirpCount, &profile.FollowerCount, &profile.FollowingCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Profile{}, ErrUserNotFound
+	}
+	return profile, err
+}
+func (s *SQLiteDB) UserLogin(email, password string) (UserResponse, error) {
+	user, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = ?`, email))
+	if errors.Is(err, ErrUserNotFound) {
+		return UserResponse{}, errors.New("Invalid information")
+	}
+	if err != nil {
+		return UserResponse{}, err
+	}
+	if err := bcrypt.CompareHashAndPassword(user.Password, []byte(password)); err != nil {
+		return UserResponse{}, errors.New("Invalid information")
+	}
+	return userResponse(&user), nil
+}
+func (s *SQLiteDB) UpdateUser(id int, update UserUpdate) (UserResponse, error) {
+	if update.Password != nil {
+		user, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+		if err != nil {
+			return UserResponse{}, err
+		}
+		if err := update.hashPassword(user.Password); err != nil {
+			return UserResponse{}, err
+		}
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return UserResponse{}, err
+	}
+	defer tx.Rollback()
+	user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if err != nil {
+		return UserResponse{}, err
+	}
+	if err := update.apply(&user, emailTaken(tx), handleTaken(tx)); err != nil {
+		return UserResponse{}, err
+	}
+	_, err = tx.Exec(`UPDATE users SET email = ?, password = ?, handle = ?, display_name = ?, bio = ?, avatar_url = ? WHERE id = ?`,
+		user.Email, user.Password, user.Handle, user.DisplayName, user.Bio, user.AvatarURL, id)
+	if err != nil {
+		return UserResponse{}, err
+	}
+	return userResponse(&user), tx.Commit()
+}
+func (s *SQLiteDB) userExists(id int) error {
+	var exists bool
+	if err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)`, id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	return nil
+}
+func (s *SQLiteDB) FollowUser(followerId, followeeId int) error {
+	if followerId == followeeId {
+		return ErrFollowSelf
+	}
+	if err := s.userExists(followeeId); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?)`, followerId, followeeId, unixMilli(time.Now()))
+	return err
+}
+func (s *SQLiteDB) UnfollowUser(followerId, followeeId int) error {
+	if err := s.userExists(followeeId); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM follows WHERE follower_id = ? AND followee_id = ?`, followerId, followeeId)
+	return err
+}
+func (s *SQLiteDB) GetFollowers(userId int) ([]Follow, error) {
+	return s.queryFollows(userId, `SELECT follower_id, created_at FROM follows WHERE followee_id = ? ORDER BY created_at DESC, follower_id`)
+}
+func (s *SQLiteDB) GetFollowing(userId int) ([]Follow, error) {
+	return s.queryFollows(userId, `SELECT followee_id, created_at FROM follows WHERE follower_id = ? ORDER BY created_at DESC, followee_id`)
+}
+func (s *SQLiteDB) queryFollows(userId int, query string) ([]Follow, error) {
+	if err := s.userExists(userId); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Follow{}
+	for rows.Next() {
+		var follow Follow
+		var createdAt int64
+		if err := rows.Scan(&follow.UserId, &createdAt); err != nil {
+			return nil, err
+		}
+		follow.CreatedAt = time.UnixMilli(createdAt).UTC()
+		list = append(list, follow)
+	}
+	return list, rows.Err()
+}
+func (s *SQLiteDB) LikeChirp(chirpId, userId int) error {
+	if _, err := s.GetChirp(chirpId); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO likes (chirp_id, user_id, created_at) VALUES (?, ?, ?)`, chirpId, userId, unixMilli(time.Now()))
+	return err
+}
+func (s *SQLiteDB) UnlikeChirp(chirpId, userId int) error {
+	if _, err := s.GetChirp(chirpId); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM likes WHERE chirp_id = ? AND user_id = ?`, chirpId, userId)
+	return err
+}
+func (s *SQLiteDB) ChirpStats(ids []int, userId int) (map[int]ChirpStats, error) {
+	stats := make(map[int]ChirpStats, len(ids))
+	if len(ids) == 0 {
+		return stats, nil
+	}
+	in := `(?` + strings.Repeat(`, ?`, len(ids)-1) + `)`
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := s.db.Query(`SELECT chirp_id, COUNT(*), MAX(user_id = ?), 0, 0 FROM likes WHERE chirp_id IN `+in+` GROUP BY chirp_id
+UNION ALL SELECT rechirp_of, 0, 0, COUNT(*), 0 FROM chirps WHERE rechirp_of IN `+in+` AND deleted_at IS NULL GROUP BY rechirp_of
+UNION ALL SELECT quote_of, 0, 0, 0, COUNT(*) FROM chirps WHERE quote_of IN `+in+` AND deleted_at IS NULL GROUP BY quote_of`,
+		append(append(append([]any{userId}, args...), args...), args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var row ChirpStats
+		if err := rows.Scan(&id, &row.Likes, &row.Liked, &row.Rechirps, &row.Quotes); err != nil {
+			return nil, err
+		}
+		stat := stats[id]
+		stat.Likes += row.Likes
+		stat.Liked = stat.Liked || row.Liked
+		stat.Rechirps += row.Rechirps
+		stat.Quotes += row.Quotes
+		stats[id] = stat
+	}
+	return stats, rows.Err()
+}
+func (s *SQLiteDB) GetLikedChirps(userId int) ([]Chirp, error) {
+	if err := s.userExists(userId); err != nil {
+		return nil, err
+	}
+	return s.queryChirps(`SELECT `+qualifiedChirpColumns+` FROM likes JOIN chirps ON chirps.id = likes.chirp_id
+WHERE likes.user_id = ? AND chirps.deleted_at IS NULL ORDER BY likes.created_at DESC, chirps.id DESC`, userId)
+}
+func insertRefreshToken(tx *sql.Tx, rt RefreshToken) error {
+	_, err := tx.Exec(`INSERT INTO refresh_tokens (hash, family_id, user_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		rt.Hash, rt.FamilyId, rt.UserId, unixMilli(rt.CreatedAt), unixMilli(rt.ExpiresAt))
+	return err
+}
+func insertSession(tx *sql.Tx, session Session) error {
+	_, err := tx.Exec(`INSERT INTO sessions (id, user_id, ip, user_agent, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		session.Id, session.UserId, session.IP, session.UserAgent, unixMilli(session.CreatedAt), unixMilli(session.LastUsedAt), unixMilli(session.ExpiresAt))
+	return err
+}
+func (s *SQLiteDB) IssueRefreshToken(userId int, ttl time.Duration, client Client) (IssuedToken, error) {
+	if err := s.userExists(userId); err != nil {
+		return IssuedToken{}, err
+	}
+	issued, stored, err := newRefreshToken(userId, "", ttl)
+	if err != nil {
+		return IssuedToken{}, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return IssuedToken{}, err
+	}
+	defer tx.Rollback()
+	if err := insertRefreshToken(tx, stored); err != nil {
+		return IssuedToken{}, err
+	}
+	if err := insertSession(tx, newSession(stored, client)); err != nil {
+		return IssuedToken{}, err
+	}
+	return issued, tx.Commit()
+}
+
+// RotateRefreshToken claims the token with a conditional update before
+// reading it, so the transaction writes first and takes the write lock up
+// front. Of two concurrent rotations the loser finds the token already
+// rotated and is treated as reuse, rather than failing with SQLITE_BUSY on
+// upgrading a read to a write.
+func (s *SQLiteDB) RotateRefreshToken(token string, ttl time.Duration, client Client) (IssuedToken, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return IssuedToken{}, err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	hash := hashRefreshToken(token)
+	res, err := tx.Exec(`UPDATE refresh_tokens SET rotated_at = ? WHERE hash = ? AND rotated_at IS NULL AND revoked_at IS NULL AND expires_at > ?`,
+		unixMilli(now), hash, unixMilli(now))
+	if err != nil {
+		return IssuedToken{}, err
+	}
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return IssuedToken{}, err
+	}
+	var rt RefreshToken
+	var createdAt, expiresAt int64
+	var rotatedAt, revokedAt sql.NullInt64
+	err = tx.QueryRow(`SELECT hash, family_id, user_id, created_at, expires_at, rotated_at, revoked_at FROM refresh_tokens WHERE hash = ?`, hash).
+		Scan(&rt.Hash, &rt.FamilyId, &rt.UserId, &createdAt, &expiresAt, &rotatedAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return IssuedToken{}, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return IssuedToken{}, err
+	}
+	rt.CreatedAt = time.UnixMilli(createdAt).UTC()
+	rt.ExpiresAt = time.UnixMilli(expiresAt).UTC()
+	rt.RotatedAt = fromUnixMilli(rotatedAt)
+	rt.RevokedAt = fromUnixMilli(revokedAt)
+	if claimed == 0 {
+		if !rt.usable(now) || rt.RotatedAt == nil {
+			return IssuedToken{}, ErrInvalidRefreshToken
+		}
+		if err := revokeFamily(tx, rt.FamilyId, now); err != nil {
+			return IssuedToken{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return IssuedToken{}, err
+		}
+		return IssuedToken{}, &TokenReuseError{UserId: rt.UserId, FamilyId: rt.FamilyId}
+	}
+	issued, stored, err := newRefreshToken(rt.UserId, rt.FamilyId, ttl)
+	if err != nil {
+		return IssuedToken{}, err
+	}
+	if err := insertRefreshToken(tx, stored); err != nil {
+		return IssuedToken{}, err
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET ip = ?, user_agent = ?, last_used_at = ?, expires_at = ? WHERE id = ?`,
+		client.IP, client.UserAgent, unixMilli(now), unixMilli(stored.ExpiresAt), rt.FamilyId); err != nil {
+		return IssuedToken{}, err
+	}
+	return issued, tx.Commit()
+}
+func revokeFamily(tx *sql.Tx, familyId string, now time.Time) error {
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL`, unixMilli(now), familyId); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, unixMilli(now), familyId)
+	return err
+}
+func (s *SQLiteDB) RevokeRefreshToken(token string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var familyId string
+	err = tx.QueryRow(`SELECT family_id FROM refresh_tokens WHERE hash = ? AND revoked_at IS NULL`, hashRefreshToken(token)).Scan(&familyId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return err
+	}
+	if err := revokeFamily(tx, familyId, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+func (s *SQLiteDB) PurgeRefreshTokens(before time.Time) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM refresh_tokens WHERE expires_at < ?`, unixMilli(before))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE id NOT IN (SELECT family_id FROM refresh_tokens)`); err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+const sessionColumns = `id, user_id, ip, user_agent, created_at, last_used_at, expires_at, revoked_at`
+
+func scanSession(row scanner) (Session, error) {
+	var session Session
+	var createdAt, lastUsedAt, expiresAt int64
+	var revokedAt sql.NullInt64
+	err := row.Scan(&session.Id, &session.UserId, &session.IP, &session.UserAgent, &createdAt, &lastUsedAt, &expiresAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrSessionNotFound
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	session.CreatedAt = time.UnixMilli(createdAt).UTC()
+	session.LastUsedAt = time.UnixMilli(lastUsedAt).UTC()
+	session.ExpiresAt = time.UnixMilli(expiresAt).UTC()
+	session.RevokedAt = fromUnixMilli(revokedAt)
+	return session, nil
+}
+func (s *SQLiteDB) ListSessions(userId int) ([]Session, error) {
+	rows, err := s.db.Query(`SELECT `+sessionColumns+` FROM sessions WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?`,
+		userId, unixMilli(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortSessions(sessions)
+	return sessions, nil
+}
+func (s *SQLiteDB) GetSession(id string) (Session, error) {
+	return scanSession(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id))
+}
+func (s *SQLiteDB) RevokeSession(userId int, id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	session, err := scanSession(tx.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if session.UserId != userId || !session.active(now) {
+		return ErrSessionNotFound
+	}
+	if err := revokeFamily(tx, id, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+func (s *SQLiteDB) RevokeOtherSessions(userId int, keep string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	now := unixMilli(time.Now())
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = ? WHERE revoked_at IS NULL AND family_id IN
+		(SELECT id FROM sessions WHERE user_id = ? AND id != ? AND revoked_at IS NULL AND expires_at > ?)`, now, userId, keep, now); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND id != ? AND revoked_at IS NULL AND expires_at > ?`, now, userId, keep, now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+func (s *SQLiteDB) FlagChirp(chirpId int, flags []Flag) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM chirps WHERE id = ? AND deleted_at IS NULL)`, chirpId).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrChirpNotFound
+	}
+	now := unixMilli(time.Now())
+	for _, flag := range flags {
+		if _, err := tx.Exec(`INSERT INTO flags (chirp_id, rule, reason, start_offset, end_offset, flagged_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			chirpId, flag.Rule, flag.Reason, flag.Start, flag.End, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+func (s *SQLiteDB) GetFlags(limit int) ([]Flag, error) {
+	rows, err := s.db.Query(`SELECT chirp_id, rule, reason, start_offset, end_offset, flagged_at FROM
+		(SELECT * FROM flags ORDER BY id DESC LIMIT ?) ORDER BY id`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	flags := []Flag{}
+	for rows.Next() {
+		var flag Flag
+		var flaggedAt int64
+		if err := rows.Scan(&flag.ChirpId, &flag.Rule, &flag.Reason, &flag.Start, &flag.End, &flaggedAt); err != nil {
+			return nil, err
+		}
+		flag.FlaggedAt = time.UnixMilli(flaggedAt).UTC()
+		flags = append(flags, flag)
+	}
+	return flags, rows.Err()
+}
+
+// Timestamps are stored as unix milliseconds so they compare and index as
+// plain integers.
+func unixMilli(t time.Time) int64 {
+	return t.UnixMilli()
+}
+func fromUnixMilli(n sql.NullInt64) *time.Time {
+	if !n.Valid {
+		return nil
+	}
+	t := time.UnixMilli(n.Int64).UTC()
+	return &t
+}
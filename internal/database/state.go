@@ -0,0 +1,197 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// createUser takes the password already hashed, as bcrypt is too slow to
+// run under the lock.
+func (dbSuper *DBSuper) createUser(email string, password []byte, handle string) (walEntry, error) {
+	if taken, _ := dbSuper.emailTaken(email); taken {
+		return walEntry{}, ErrEmailTaken
+	}
+	if handle == "" {
+		handle, _ = handleFromEmail(email, dbSuper.handleTaken)
+	}
+	if !validHandle(handle) {
+		return walEntry{}, ErrInvalidHandle
+	}
+	if _, taken := dbSuper.userByHandle(handle); taken {
+		return walEntry{}, ErrHandleTaken
+	}
+	newInternalUser := UserInternal{
+		Email:    email,
+		Handle:   handle,
+		Id:       dbSuper.DBStructure.UserAmount + 1,
+		Password: password,
+	}
+	return walEntry{Op: opUserCreated, User: &newInternalUser}, nil
+}
+
+// userByEmail finds who logs in with email, with a copy of their password
+// hash so it can be checked by checkLogin once the lock is released.
+// bcrypt is slow enough that checking it under the lock holds up writers.
+func (dbSuper *DBSuper) userByEmail(email string) (UserInternal, bool) {
+	for _, user := range dbSuper.UserInternal {
+		if user.Email == email {
+			user.Password = bytes.Clone(user.Password)
+			return user, true
+		}
+	}
+	return UserInternal{}, false
+}
+
+// passwordHash is a copy of the password hash of user id, for
+// UserUpdate.hashPassword to check outside the lock.
+func (dbSuper *DBSuper) passwordHash(id int) ([]byte, error) {
+	user, ok := dbSuper.userById(id)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return bytes.Clone(user.Password), nil
+}
+func checkLogin(user UserInternal, found bool, password string) (UserResponse, error) {
+	if !found {
+		return UserResponse{}, errors.New("Invalid information")
+	}
+	err := bcrypt.CompareHashAndPassword(user.Password, []byte(password))
+	if err != nil {
+		return UserResponse{}, errors.New("Invalid information")
+	}
+	return userResponse(&user), nil
+}
+func (dbSuper *DBSuper) getUser(id int) (UserResponse, error) {
+	user, ok := dbSuper.userById(id)
+	if !ok {
+		return UserResponse{}, ErrUserNotFound
+	}
+	return userResponse(&user), nil
+}
+func (dbSuper *DBSuper) updateUser(id int, update UserUpdate) (walEntry, error) {
+	user, ok := dbSuper.userById(id)
+	if !ok {
+		return walEntry{}, ErrUserNotFound
+	}
+	errU := update.apply(&user, dbSuper.emailTaken, dbSuper.handleTaken)
+	if errU != nil {
+		return walEntry{}, errU
+	}
+	return walEntry{Op: opUserUpdated, User: &user}, nil
+}
+func (dbSuper *DBSuper) createChirp(body string, authorId, inReplyTo, quoteOf int) (walEntry, error) {
+	now := time.Now().UTC()
+	newChirp := Chirp{
+		Id:        dbSuper.DBStructure.ChirpAmount + 1,
+		Body:      body,
+		AuthorId:  authorId,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	entities, err := parseEntities(body, dbSuper.resolveHandle)
+	if err != nil {
+		return walEntry{}, err
+	}
+	newChirp.Entities = entities
+	newChirp.ConversationId = newChirp.Id
+	if inReplyTo != 0 {
+		parent, err := dbSuper.getChirp(inReplyTo)
+		if err != nil {
+			return walEntry{}, ErrParentNotFound
+		}
+		newChirp.InReplyTo = &parent.Id
+		newChirp.ConversationId = parent.ConversationId
+	}
+	if quoteOf != 0 {
+		original, err := dbSuper.original(quoteOf)
+		if err != nil {
+			return walEntry{}, err
+		}
+		newChirp.QuoteOf = &original.Id
+	}
+	return walEntry{Op: opChirpCreated, Chirp: &newChirp}, nil
+}
+func (dbSuper *DBSuper) getChirp(id int) (Chirp, error) {
+	if val, ok := dbSuper.DBStructure.Chirps[id]; ok && val.DeletedAt == nil {
+		return val, nil
+	}
+	return Chirp{}, ErrChirpNotFound
+}
+func (dbSuper *DBSuper) updateChirp(id, authorId int, body string) (walEntry, error) {
+	val, err := dbSuper.getChirp(id)
+	if err != nil {
+		return walEntry{}, err
+	}
+	if val.AuthorId != authorId {
+		return walEntry{}, ErrIdMismatch
+	}
+	if val.RechirpOf != nil {
+		return walEntry{}, ErrRechirpEdit
+	}
+	val.Entities, err = parseEntities(body, dbSuper.resolveHandle)
+	if err != nil {
+		return walEntry{}, err
+	}
+	val.Body = body
+	val.UpdatedAt = time.Now().UTC()
+	return walEntry{Op: opChirpUpdated, Chirp: &val}, nil
+}
+func (dbSuper *DBSuper) getChirpHistory(id int) ([]ChirpRevision, error) {
+	val, err := dbSuper.getChirp(id)
+	if err != nil {
+		return nil, err
+	}
+	revisions := append([]ChirpRevision{}, dbSuper.DBStructure.Revisions[id]...)
+	return append(revisions, ChirpRevision{Body: val.Body, CreatedAt: val.UpdatedAt}), nil
+}
+func (dbSuper *DBSuper) deleteChirp(id, authorId int) (walEntry, error) {
+	val, err := dbSuper.getChirp(id)
+	if err != nil {
+		return walEntry{}, err
+	}
+	if val.AuthorId != authorId {
+		return walEntry{}, ErrIdMismatch
+	}
+	now := time.Now().UTC()
+	return walEntry{Op: opChirpTrashed, Id: id, Time: &now}, nil
+}
+func (dbSuper *DBSuper) restoreChirp(id, authorId int, window time.Duration) (walEntry, error) {
+	val, ok := dbSuper.DBStructure.Chirps[id]
+	if !ok || val.DeletedAt == nil {
+		return walEntry{}, ErrChirpNotFound
+	}
+	if val.AuthorId != authorId {
+		return walEntry{}, ErrIdMismatch
+	}
+	if time.Since(*val.DeletedAt) > window {
+		return walEntry{}, ErrRestoreExpired
+	}
+	if val.RechirpOf != nil {
+		if _, ok := dbSuper.activeRechirp(*val.RechirpOf, authorId); ok {
+			return walEntry{}, ErrAlreadyRechirped
+		}
+	}
+	return walEntry{Op: opChirpRestored, Id: id}, nil
+}
+func (dbSuper *DBSuper) purgeChirps(before time.Time) []walEntry {
+	var entries []walEntry
+	for id, chirp := range dbSuper.DBStructure.Chirps {
+		if chirp.DeletedAt != nil && chirp.DeletedAt.Before(before) {
+			entries = append(entries, walEntry{Op: opChirpDeleted, Id: id})
+		}
+	}
+	return entries
+}
+func userResponse(user *UserInternal) UserResponse {
+	return UserResponse{
+		Id:          user.Id,
+		Email:       user.Email,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   user.AvatarURL,
+	}
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrChirpNotFound  = errors.New("Chirp not found")
+	ErrIdMismatch     = errors.New("Id mismatch")
+	ErrRestoreExpired = errors.New("Restore window has passed")
+)
+
+type Store interface {
+	CreateChirp(body string, authorId, inReplyTo, quoteOf int) (Chirp, error)
+	GetChirps(q ChirpQuery) ([]Chirp, error)
+	GetChirp(id int) (Chirp, error)
+	UpdateChirp(id, authorId int, body string) (Chirp, error)
+	GetChirpHistory(id int) ([]ChirpRevision, error)
+	GetThread(id int) (Thread, error)
+	SearchChirps(q SearchQuery) ([]Chirp, error)
+	DeleteChirp(id, authorId int) error
+	Rechirp(id, authorId int) (Chirp, error)
+	Unrechirp(id, authorId int) error
+	RestoreChirp(id, authorId int, window time.Duration) (Chirp, error)
+	PurgeChirps(before time.Time) (int, error)
+	CreateUser(email, password, handle string) (UserResponse, error)
+	GetUser(id int) (UserResponse, error)
+	GetUserByHandle(handle string) (UserResponse, error)
+	GetProfile(id int) (Profile, error)
+	UserLogin(email, password string) (UserResponse, error)
+	UpdateUser(id int, update UserUpdate) (UserResponse, error)
+	FollowUser(followerId, followeeId int) error
+	UnfollowUser(followerId, followeeId int) error
+	GetFollowers(userId int) ([]Follow, error)
+	GetFollowing(userId int) ([]Follow, error)
+	LikeChirp(chirpId, userId int) error
+	UnlikeChirp(chirpId, userId int) error
+	ChirpStats(ids []int, userId int) (map[int]ChirpStats, error)
+	GetLikedChirps(userId int) ([]Chirp, error)
+	IssueRefreshToken(userId int, ttl time.Duration, client Client) (IssuedToken, error)
+	RotateRefreshToken(token string, ttl time.Duration, client Client) (IssuedToken, error)
+	RevokeRefreshToken(token string) error
+	PurgeRefreshTokens(before time.Time) (int, error)
+	ListSessions(userId int) ([]Session, error)
+	GetSession(id string) (Session, error)
+	RevokeSession(userId int, id string) error
+	RevokeOtherSessions(userId int, keep string) (int, error)
+	FlagChirp(chirpId int, flags []Flag) error
+	GetFlags(limit int) ([]Flag, error)
+	Close() error
+}
+
+var _ Store = (*DB)(nil)
+var _ Store = (*SQLiteDB)(nil)
+var _ Store = (*MemDB)(nil)
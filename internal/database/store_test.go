@@ -0,0 +1,41 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// storeBackend opens the store of a backend that keeps its data in dir,
+// reopening what an earlier call left there.
+type storeBackend struct {
+	name string
+	open func(dir string) (Store, error)
+}
+
+var persistentStores = []storeBackend{
+	{"json", func(dir string) (Store, error) { return NewDb(filepath.Join(dir, "database.json")) }},
+	{"sqlite", func(dir string) (Store, error) { return NewSQLiteDb(filepath.Join(dir, "database.sqlite")) }},
+}
+
+// allStores adds the in-memory backend, which keeps nothing across opens.
+var allStores = append([]storeBackend{
+	{"memory", func(string) (Store, error) { return NewMemDb(), nil }},
+}, persistentStores...)
+
+// openStores opens a store of each backend with alice as user 1, for
+// subtests to share.
+func openStores(t *testing.T, backends []storeBackend, run func(t *testing.T, db Store)) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			db, err := backend.open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if _, err := db.CreateUser("alice@example.com", "hunter22", "alice"); err != nil {
+				t.Fatal(err)
+			}
+			run(t, db)
+		})
+	}
+}
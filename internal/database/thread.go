@@ -0,0 +1,125 @@
+package database
+
+import (
+	"errors"
+	"sort"
+)
+
+var ErrParentNotFound = errors.New("Replied-to chirp not found")
+
+// Thread is the conversation around one chirp: the chain of chirps it
+// replies to, oldest first, and every reply beneath it.
+type Thread struct {
+	Ancestors []Chirp    `json:"ancestors"`
+	Chirp     ThreadNode `json:"chirp"`
+}
+type ThreadNode struct {
+	Chirp
+	Replies []ThreadNode `json:"replies"`
+}
+
+// buildThread assembles the thread of id from every chirp in its
+// conversation, given in id order. Deleted chirps that still have live
+// replies stay in the tree as tombstones so it doesn't break apart.
+func buildThread(id int, conversation []Chirp) (Thread, error) {
+	byId := make(map[int]Chirp, len(conversation))
+	replies := map[int][]int{}
+	for _, chirp := range conversation {
+		byId[chirp.Id] = chirp
+		if chirp.InReplyTo != nil {
+			replies[*chirp.InReplyTo] = append(replies[*chirp.InReplyTo], chirp.Id)
+		}
+	}
+	chirp, ok := byId[id]
+	if !ok || chirp.DeletedAt != nil {
+		return Thread{}, ErrChirpNotFound
+	}
+	ancestors := []Chirp{}
+	for parent := chirp.InReplyTo; parent != nil; {
+		ancestor, ok := byId[*parent]
+		if !ok {
+			break
+		}
+		ancestors = append(ancestors, redactDeleted(ancestor))
+		parent = ancestor.InReplyTo
+	}
+	for i, j := 0, len(ancestors)-1; i < j; i, j = i+1, j-1 {
+		ancestors[i], ancestors[j] = ancestors[j], ancestors[i]
+	}
+	node, _ := threadNode(id, byId, replies)
+	return Thread{Ancestors: ancestors, Chirp: node}, nil
+}
+
+// threadNode reports false for a deleted chirp with no live replies, which
+// is left out of the tree.
+func threadNode(id int, byId map[int]Chirp, replies map[int][]int) (ThreadNode, bool) {
+	node := ThreadNode{Chirp: redactDeleted(byId[id]), Replies: []ThreadNode{}}
+	for _, replyId := range replies[id] {
+		if reply, ok := threadNode(replyId, byId, replies); ok {
+			node.Replies = append(node.Replies, reply)
+		}
+	}
+	return node, node.DeletedAt == nil || len(node.Replies) > 0
+}
+
+// redactDeleted turns a deleted chirp into a tombstone that keeps only
+// what holds the thread together: who wrote it, where it sits and when it
+// was deleted.
+func redactDeleted(chirp Chirp) Chirp {
+	if chirp.DeletedAt == nil {
+		return chirp
+	}
+	return Chirp{
+		Id:             chirp.Id,
+		AuthorId:       chirp.AuthorId,
+		InReplyTo:      chirp.InReplyTo,
+		ConversationId: chirp.ConversationId,
+		DeletedAt:      chirp.DeletedAt,
+	}
+}
+func (dbSuper *DBSuper) getThread(id int) (Thread, error) {
+	chirp, ok := dbSuper.DBStructure.Chirps[id]
+	if !ok {
+		return Thread{}, ErrChirpNotFound
+	}
+	ids := dbSuper.conversations[chirp.ConversationId]
+	conversation := make([]Chirp, 0, len(ids))
+	for _, id := range ids {
+		conversation = append(conversation, dbSuper.DBStructure.Chirps[id])
+	}
+	return buildThread(id, conversation)
+}
+func (dbSuper *DBSuper) indexReply(chirp Chirp) {
+	ids := dbSuper.conversations[chirp.ConversationId]
+	i := sort.SearchInts(ids, chirp.Id)
+	if i < len(ids) && ids[i] == chirp.Id {
+		return
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = chirp.Id
+	dbSuper.conversations[chirp.ConversationId] = ids
+}
+
+// unindexReply drops a purged chirp from its conversation. Its replies are
+// kept but no longer point at it.
+func (dbSuper *DBSuper) unindexReply(chirp Chirp) {
+	ids := dbSuper.conversations[chirp.ConversationId]
+	kept := ids[:0]
+	for _, id := range ids {
+		if id == chirp.Id {
+			continue
+		}
+		kept = append(kept, id)
+		reply := dbSuper.DBStructure.Chirps[id]
+		if reply.InReplyTo != nil && *reply.InReplyTo == chirp.Id {
+			reply.InReplyTo = nil
+			dbSuper.DBStructure.Chirps[id] = reply
+		}
+	}
+	if len(kept) == 0 {
+		delete(dbSuper.conversations, chirp.ConversationId)
+		return
+	}
+	dbSuper.conversations[chirp.ConversationId] = kept
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shape draws a thread node as id(replies...).
+func shape(node ThreadNode) string {
+	if len(node.Replies) == 0 {
+		return fmt.Sprint(node.Id)
+	}
+	replies := make([]string, len(node.Replies))
+	for i, reply := range node.Replies {
+		replies[i] = shape(reply)
+	}
+	return fmt.Sprintf("%d(%s)", node.Id, strings.Join(replies, ","))
+}
+
+func TestThreads(t *testing.T) {
+	openStores(t, allStores, func(t *testing.T, db Store) {
+		for _, c := range []struct {
+			body      string
+			inReplyTo int
+		}{
+			{"root", 0},
+			{"#go with @alice", 1},
+			{"deeper", 2},
+			{"another reply", 1},
+			{"deepest", 3},
+		} {
+			if _, err := db.CreateChirp(c.body, 1, c.inReplyTo, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.CreateChirp("reply to nothing", 1, 99, 0); !errors.Is(err, ErrParentNotFound) {
+			t.Errorf("reply to a missing chirp = %v, want ErrParentNotFound", err)
+		}
+
+		type want struct {
+			id        int
+			ancestors string
+			shape     string
+			notFound  bool
+		}
+		check := func(step string, wants []want) {
+			t.Helper()
+			for _, w := range wants {
+				thread, err := db.GetThread(w.id)
+				if w.notFound {
+					if !errors.Is(err, ErrChirpNotFound) {
+						t.Errorf("%s: thread of %d = %v, want ErrChirpNotFound", step, w.id, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s: thread of %d: %v", step, w.id, err)
+				}
+				ancestors := make([]string, len(thread.Ancestors))
+				for i, a := range thread.Ancestors {
+					ancestors[i] = fmt.Sprint(a.Id)
+				}
+				if got := strings.Join(ancestors, ","); got != w.ancestors {
+					t.Errorf("%s: ancestors of %d = %s, want %s", step, w.id, got, w.ancestors)
+				}
+				if got := shape(thread.Chirp); got != w.shape {
+					t.Errorf("%s: thread of %d = %s, want %s", step, w.id, got, w.shape)
+				}
+			}
+		}
+
+		check("live", []want{
+			{id: 1, shape: "1(2(3(5)),4)"},
+			{id: 3, ancestors: "1,2", shape: "3(5)"},
+			{id: 5, ancestors: "1,2,3", shape: "5"},
+			{id: 99, notFound: true},
+		})
+
+		for _, id := range []int{2, 4} {
+			if err := db.DeleteChirp(id, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check("deleted", []want{
+			{id: 1, shape: "1(2(3(5)))"},
+			{id: 3, ancestors: "1,2", shape: "3(5)"},
+			{id: 2, notFound: true},
+			{id: 4, notFound: true},
+		})
+		thread, err := db.GetThread(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tombstone := thread.Ancestors[1]
+		if tombstone.Body != "" || len(tombstone.Entities.Hashtags) != 0 || len(tombstone.Entities.Mentions) != 0 {
+			t.Errorf("deleted ancestor = %+v, want its body and entities gone", tombstone)
+		}
+		if tombstone.DeletedAt == nil || tombstone.AuthorId != 1 || tombstone.InReplyTo == nil || *tombstone.InReplyTo != 1 {
+			t.Errorf("deleted ancestor = %+v, want its author, parent and deletion kept", tombstone)
+		}
+
+		if _, err := db.PurgeChirps(time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		check("purged", []want{
+			{id: 1, shape: "1"},
+			{id: 3, shape: "3(5)"},
+			{id: 5, ancestors: "3", shape: "5"},
+			{id: 2, notFound: true},
+		})
+	})
+}
@@ -0,0 +1,286 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Every mutation of the JSON store is appended to <path>.wal as one JSON
+// line and replayed on top of the snapshot in <path>. Entries carry a
+// sequence number and the snapshot records the last one it contains, so
+// replay skips anything already folded in. When the log is folded into a
+// new snapshot it is kept as <path>.wal.bak next to <path>.bak, which
+// together rebuild the state should the current snapshot be unreadable.
+const (
+	opChirpCreated   = "chirp_created"
+	opChirpUpdated   = "chirp_updated"
+	opChirpDeleted   = "chirp_deleted"
+	opChirpTrashed   = "chirp_trashed"
+	opChirpRestored  = "chirp_restored"
+	opUserCreated    = "user_created"
+	opUserUpdated    = "user_updated"
+	opTokenRevoked   = "token_revoked"
+	opFollowed       = "followed"
+	opUnfollowed     = "unfollowed"
+	opLiked          = "liked"
+	opUnliked        = "unliked"
+	opRefreshIssued  = "refresh_issued"
+	opRefreshRotated = "refresh_rotated"
+	opRefreshRevoked = "refresh_revoked"
+	opRefreshPurged  = "refresh_purged"
+	opChirpFlagged   = "chirp_flagged"
+)
+
+const (
+	snapshotInterval  = time.Minute
+	snapshotThreshold = 1000
+)
+
+type walEntry struct {
+	Seq      int64         `json:"seq,omitempty"`
+	Op       string        `json:"op"`
+	Id       int           `json:"id,omitempty"`
+	Chirp    *Chirp        `json:"chirp,omitempty"`
+	User     *UserInternal `json:"user,omitempty"`
+	Token    string        `json:"token,omitempty"`
+	Refresh  *RefreshToken `json:"refresh,omitempty"`
+	Session  *Session      `json:"session,omitempty"`
+	Flags    []Flag        `json:"flags,omitempty"`
+	UserId   int           `json:"user_id,omitempty"`
+	TargetId int           `json:"target_id,omitempty"`
+	Time     *time.Time    `json:"time,omitempty"`
+}
+
+func (dbSuper *DBSuper) apply(entry walEntry) error {
+	if entry.Seq != 0 {
+		if entry.Seq <= dbSuper.Seq {
+			return nil
+		}
+		dbSuper.Seq = entry.Seq
+	}
+	switch entry.Op {
+	case opChirpCreated:
+		if entry.Chirp.ConversationId == 0 {
+			// Logged before reply threads existed.
+			entry.Chirp.ConversationId = entry.Chirp.Id
+		}
+		dbSuper.backfillEntities(entry.Chirp)
+		dbSuper.DBStructure.Chirps[entry.Chirp.Id] = *entry.Chirp
+		dbSuper.indexChirp(*entry.Chirp)
+		dbSuper.search.add(entry.Chirp.Id, entry.Chirp.Body)
+		dbSuper.indexReply(*entry.Chirp)
+		dbSuper.indexAmplified(*entry.Chirp)
+		dbSuper.indexEntities(*entry.Chirp)
+		if entry.Chirp.Id > dbSuper.DBStructure.ChirpAmount {
+			dbSuper.DBStructure.ChirpAmount = entry.Chirp.Id
+		}
+	case opChirpUpdated:
+		old, ok := dbSuper.DBStructure.Chirps[entry.Chirp.Id]
+		if ok {
+			dbSuper.DBStructure.Revisions[old.Id] = append(dbSuper.DBStructure.Revisions[old.Id], ChirpRevision{Body: old.Body, CreatedAt: old.UpdatedAt})
+			dbSuper.unindexEntities(old)
+		}
+		dbSuper.backfillEntities(entry.Chirp)
+		dbSuper.DBStructure.Chirps[entry.Chirp.Id] = *entry.Chirp
+		dbSuper.search.add(entry.Chirp.Id, entry.Chirp.Body)
+		dbSuper.indexEntities(*entry.Chirp)
+	case opChirpDeleted:
+		if chirp, ok := dbSuper.DBStructure.Chirps[entry.Id]; ok {
+			dbSuper.unindexReply(chirp)
+			dbSuper.unindexAmplified(chirp)
+			dbSuper.unindexEntities(chirp)
+			dbSuper.unindexChirp(chirp)
+		}
+		delete(dbSuper.DBStructure.Chirps, entry.Id)
+		delete(dbSuper.DBStructure.Revisions, entry.Id)
+		dbSuper.search.remove(entry.Id)
+		dbSuper.clearLikes(entry.Id)
+		dbSuper.clearFlags(entry.Id)
+	case opChirpTrashed, opChirpRestored:
+		chirp, ok := dbSuper.DBStructure.Chirps[entry.Id]
+		if !ok {
+			return nil
+		}
+		chirp.DeletedAt = entry.Time
+		dbSuper.DBStructure.Chirps[entry.Id] = chirp
+		if chirp.DeletedAt == nil {
+			dbSuper.search.add(chirp.Id, chirp.Body)
+		} else {
+			dbSuper.search.remove(chirp.Id)
+			dbSuper.clearLikes(chirp.Id)
+		}
+	case opUserCreated, opUserUpdated:
+		if !validHandle(entry.User.Handle) {
+			// Logged before users had handles, or with an all-digit one.
+			entry.User.Handle = dbSuper.backfillHandle(*entry.User)
+		}
+		dbSuper.putUser(*entry.User)
+	case opFollowed:
+		dbSuper.applyFollow(entry)
+	case opUnfollowed:
+		dbSuper.applyUnfollow(entry)
+	case opLiked:
+		dbSuper.applyLike(entry)
+	case opUnliked:
+		dbSuper.applyUnlike(entry)
+	case opRefreshIssued, opRefreshRotated, opRefreshRevoked, opRefreshPurged:
+		dbSuper.applyRefresh(entry)
+	case opChirpFlagged:
+		dbSuper.Flags = append(dbSuper.Flags, entry.Flags...)
+	case opTokenRevoked:
+		// Denylisted a JWT refresh token. Those are no longer accepted at
+		// all, so there is nothing left to do.
+	default:
+		return fmt.Errorf("Unknown log entry %q", entry.Op)
+	}
+	return nil
+}
+func (dbSuper *DBSuper) putUser(user UserInternal) {
+	if user.Id > dbSuper.DBStructure.UserAmount {
+		dbSuper.DBStructure.UserAmount = user.Id
+	}
+	for i := range dbSuper.UserInternal {
+		if dbSuper.UserInternal[i].Id == user.Id {
+			dbSuper.UserInternal[i] = user
+			return
+		}
+	}
+	dbSuper.UserInternal = append(dbSuper.UserInternal, user)
+}
+func (db *DB) walPath() string {
+	return db.path + ".wal"
+}
+func (db *DB) openLog() error {
+	f, err := os.OpenFile(db.walPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	db.wal = f
+	db.walSize = info.Size()
+	return nil
+}
+
+// appendLog writes entries to the log and fsyncs it. A failed write is
+// cut back off so the log never ends in a torn line we'd append after.
+func (db *DB) appendLog(entries []walEntry) error {
+	var buf []byte
+	for i := range entries {
+		entries[i].Seq = db.data.Seq + int64(i) + 1
+		dat, err := json.Marshal(entries[i])
+		if err != nil {
+			return err
+		}
+		buf = append(buf, dat...)
+		buf = append(buf, '\n')
+	}
+	_, err := db.wal.Write(buf)
+	if err == nil {
+		err = db.wal.Sync()
+	}
+	if err != nil {
+		db.wal.Truncate(db.walSize)
+		return err
+	}
+	db.walSize += int64(len(buf))
+	db.walEntries += len(entries)
+	if db.walEntries >= snapshotThreshold {
+		select {
+		case db.compactCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// replayLog applies the log on top of dbSuper. A final line that doesn't
+// decode is a write that was cut short by a crash and is skipped.
+func replayLog(walPath string, dbSuper *DBSuper) error {
+	data, err := os.ReadFile(walPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		entry := walEntry{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			if i == len(lines)-1 {
+				log.Printf("Ignoring torn entry at the end of %s", walPath)
+				break
+			}
+			return fmt.Errorf("Corrupt log entry on line %d of %s: %w", i+1, walPath, err)
+		}
+		if err := dbSuper.apply(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commit makes entries durable in the log before applying them to the
+// cached state, so readers never see a change that could still be lost.
+func (db *DB) commit(entries ...walEntry) error {
+	if err := db.appendLog(entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := db.data.apply(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compact writes the cached state as the new snapshot and starts a new
+// log, keeping the old one as the backup's log.
+func (db *DB) compact() error {
+	dat, err := json.Marshal(db.data)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(db.path, dat); err != nil {
+		return err
+	}
+	if err := db.wal.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(db.walPath(), backupPath(db.walPath())); err != nil {
+		return err
+	}
+	db.walEntries = 0
+	return db.openLog()
+}
+func (db *DB) compactLoop() {
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-ticker.C:
+		case <-db.compactCh:
+		}
+		db.mux.Lock()
+		if db.walEntries > 0 {
+			if err := db.compact(); err != nil {
+				log.Printf("Error writing snapshot: %v", err)
+			}
+		}
+		db.mux.Unlock()
+	}
+}
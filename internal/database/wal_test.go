@@ -0,0 +1,196 @@
+package database
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestDb(t *testing.T, path string) *DB {
+	t.Helper()
+	db, err := NewDb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// crash stops db the way a killed process would, without the snapshot
+// Close writes.
+func crash(db *DB) {
+	close(db.done)
+	db.wal.Close()
+}
+
+func createChirps(t *testing.T, db Store, bodies ...string) {
+	t.Helper()
+	for _, body := range bodies {
+		if _, err := db.CreateChirp(body, 1, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func logLine(t *testing.T, entry walEntry) string {
+	t.Helper()
+	dat, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(dat)
+}
+
+func TestReplayLog(t *testing.T) {
+	chirp := func(seq int64, id int) string {
+		return logLine(t, walEntry{Seq: seq, Op: opChirpCreated, Chirp: &Chirp{Id: id, Body: "chirp", AuthorId: 1}})
+	}
+	tests := []struct {
+		name      string
+		snapSeq   int64
+		log       []string
+		wantIds   []int
+		wantErr   bool
+		noLogFile bool
+	}{
+		{name: "applies every entry", log: []string{chirp(1, 1), chirp(2, 2)}, wantIds: []int{1, 2}},
+		{name: "skips a torn final line", log: []string{chirp(1, 1), chirp(2, 2), `{"seq":3,"op":"chirp_cre`}, wantIds: []int{1, 2}},
+		{name: "skips blank lines", log: []string{chirp(1, 1), "", chirp(2, 2), ""}, wantIds: []int{1, 2}},
+		{name: "rejects a corrupt line before the end", log: []string{chirp(1, 1), `garbage`, chirp(2, 2)}, wantErr: true},
+		{name: "rejects unknown entries", log: []string{logLine(t, walEntry{Seq: 1, Op: "chirp_exploded"})}, wantErr: true},
+		{name: "skips entries the snapshot holds", snapSeq: 1, log: []string{chirp(1, 1), chirp(2, 2)}, wantIds: []int{2}},
+		{name: "missing log", noLogFile: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			walPath := filepath.Join(t.TempDir(), "database.json.wal")
+			if !tt.noLogFile {
+				if err := os.WriteFile(walPath, []byte(strings.Join(tt.log, "\n")), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			dbSuper := newDBSuper()
+			dbSuper.Seq = tt.snapSeq
+			err := replayLog(walPath, &dbSuper)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("replay succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dbSuper.DBStructure.Chirps) != len(tt.wantIds) {
+				t.Fatalf("got %d chirps, want %v", len(dbSuper.DBStructure.Chirps), tt.wantIds)
+			}
+			for _, id := range tt.wantIds {
+				if _, ok := dbSuper.DBStructure.Chirps[id]; !ok {
+					t.Errorf("chirp %d missing", id)
+				}
+			}
+		})
+	}
+}
+
+// TestCrashRecovery kills the store at the points compaction can be cut
+// short and checks nothing committed is lost or applied twice.
+func TestCrashRecovery(t *testing.T) {
+	tests := []struct {
+		name string
+		// crash leaves the files of db, which has just committed chirps
+		// 1 and 2 and an edit of chirp 1, as a crash would.
+		crash func(t *testing.T, db *DB)
+	}{
+		{
+			name:  "before any snapshot",
+			crash: func(t *testing.T, db *DB) { crash(db) },
+		},
+		{
+			name: "mid append",
+			crash: func(t *testing.T, db *DB) {
+				if _, err := db.wal.WriteString(`{"seq":4,"op":"chirp_created","chirp":{"id":3,`); err != nil {
+					t.Fatal(err)
+				}
+				crash(db)
+			},
+		},
+		{
+			name: "after the old snapshot became the backup",
+			crash: func(t *testing.T, db *DB) {
+				crash(db)
+				if err := os.Rename(db.path, backupPath(db.path)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "after the snapshot but before the log was set aside",
+			crash: func(t *testing.T, db *DB) {
+				log, err := os.ReadFile(db.walPath())
+				if err != nil {
+					t.Fatal(err)
+				}
+				db.mux.Lock()
+				if err := db.compact(); err != nil {
+					t.Fatal(err)
+				}
+				db.mux.Unlock()
+				crash(db)
+				// Put the log back as it was before it was renamed.
+				if err := os.WriteFile(db.walPath(), log, 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db := openTestDb(t, path)
+			createChirps(t, db, "first", "second")
+			if _, err := db.UpdateChirp(1, 1, "first, edited"); err != nil {
+				t.Fatal(err)
+			}
+			tt.crash(t, db)
+
+			db = openTestDb(t, path)
+			defer db.Close()
+			chirps, _ := db.GetChirps(ChirpQuery{})
+			if len(chirps) != 2 {
+				t.Fatalf("got %d chirps after recovery, want 2", len(chirps))
+			}
+			history, err := db.GetChirpHistory(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 2 || history[0].Body != "first" || history[1].Body != "first, edited" {
+				t.Errorf("history after recovery = %+v, want the one edit", history)
+			}
+			// New writes carry on from the recovered sequence.
+			createChirps(t, db, "third")
+			if chirp, err := db.GetChirp(3); err != nil || chirp.Body != "third" {
+				t.Errorf("chirp 3 = %+v, %v after recovery", chirp, err)
+			}
+		})
+	}
+}
+
+func TestReopenAfterClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDb(t, path)
+	createChirps(t, db, "first", "second")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(db.walPath()); err != nil || info.Size() != 0 {
+		t.Errorf("log after Close: %v, %v, want it folded into the snapshot", info, err)
+	}
+	db = openTestDb(t, path)
+	defer db.Close()
+	chirps, _ := db.GetChirps(ChirpQuery{})
+	if len(chirps) != 2 {
+		t.Errorf("got %d chirps after reopening, want 2", len(chirps))
+	}
+}
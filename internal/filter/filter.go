@@ -0,0 +1,347 @@
+// Package filter screens chirp bodies against rules loaded from a JSON
+// file such as
+//
+//	{
+//		"normalize": {"case_fold": true, "confusables": true, "leetspeak": true},
+//		"mask_char": "*",
+//		"rules": [
+//			{"name": "profanity", "words": ["kerfuffle", "sharbert", "fornax"], "action": "mask"},
+//			{"name": "shorteners", "pattern": "(?i)bit\\.ly/", "action": "reject", "reason": "Link shorteners aren't allowed"},
+//			{"name": "giveaways", "words": ["free giveaway"], "action": "flag"}
+//		]
+//	}
+//
+// Word lists hold words or phrases matched against whole tokens of the
+// normalized text, so "Kerfuffle!", "KЕRFUFFLE" with a Cyrillic Е and
+// "k3rfuffl3" all match "kerfuffle". Patterns are regular expressions
+// matched against the text as written, or against the normalized text when
+// the rule sets "normalized". A mask rule replaces each matched character
+// with mask_char, or the whole match with the rule's "replacement"; a
+// reject rule refuses the chirp with its reason; a flag rule lets the
+// chirp through but reports it for review.
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+type Action string
+
+const (
+	Mask   Action = "mask"
+	Reject Action = "reject"
+	Flag   Action = "flag"
+)
+
+type Rule struct {
+	Name        string   `json:"name"`
+	Words       []string `json:"words,omitempty"`
+	Pattern     string   `json:"pattern,omitempty"`
+	Normalized  bool     `json:"normalized,omitempty"`
+	Action      Action   `json:"action"`
+	Reason      string   `json:"reason,omitempty"`
+	Replacement string   `json:"replacement,omitempty"`
+}
+type Config struct {
+	Normalize Normalization `json:"normalize"`
+	MaskChar  string        `json:"mask_char,omitempty"`
+	Rules     []Rule        `json:"rules"`
+}
+
+// DefaultConfig is used when there is no config file.
+var DefaultConfig = Config{
+	Normalize: Normalization{CaseFold: true, Confusables: true, Leetspeak: true},
+	MaskChar:  "*",
+	Rules: []Rule{
+		{Name: "profanity", Words: []string{"kerfuffle", "sharbert", "fornax"}, Action: Mask},
+	},
+}
+
+// Match is a rule hit, with Start and End as byte offsets into the
+// filtered Result.Text. A hit that overlaps masked text covers the whole
+// mask.
+type Match struct {
+	Rule   string `json:"rule"`
+	Action Action `json:"action"`
+	Reason string `json:"reason,omitempty"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+
+	replacement string
+}
+
+// Result is the outcome of filtering a text. Rejected is the first hit of
+// a reject rule, in rule order, and when it is set the chirp must not be
+// stored.
+type Result struct {
+	Text     string
+	Rejected *Match
+	Flagged  []Match
+}
+
+type compiledRule struct {
+	Rule
+	phrases map[string][][]string
+	re      *regexp.Regexp
+}
+type ruleSet struct {
+	normalize Normalization
+	maskChar  string
+	rules     []compiledRule
+}
+
+// Filter holds the rules of one config file and can reload them while
+// chirps are being filtered.
+type Filter struct {
+	path string
+	mux  sync.RWMutex
+	set  *ruleSet
+}
+
+func Load(path string) (*Filter, error) {
+	f := &Filter{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload rereads the config file. The rules in use are only replaced once
+// the new ones have compiled, so a broken file leaves them in place.
+func (f *Filter) Reload() error {
+	cfg, err := readConfig(f.path)
+	if err != nil {
+		return err
+	}
+	set, err := compile(cfg)
+	if err != nil {
+		return fmt.Errorf("Invalid filter config %s: %w", f.path, err)
+	}
+	f.mux.Lock()
+	f.set = set
+	f.mux.Unlock()
+	return nil
+}
+func readConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No filter config at %s, using the built-in rules", path)
+		return DefaultConfig, nil
+	}
+	if err != nil {
+		return Config{}, err
+	}
+	cfg := Config{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return Config{}, fmt.Errorf("Invalid filter config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+func compile(cfg Config) (*ruleSet, error) {
+	set := &ruleSet{normalize: cfg.Normalize, maskChar: cfg.MaskChar}
+	if set.maskChar == "" {
+		set.maskChar = "*"
+	}
+	for i, rule := range cfg.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i+1)
+		}
+		switch rule.Action {
+		case Mask, Reject, Flag:
+		default:
+			return nil, fmt.Errorf("rule %q has unknown action %q, expected mask, reject or flag", rule.Name, rule.Action)
+		}
+		if (len(rule.Words) == 0) == (rule.Pattern == "") {
+			return nil, fmt.Errorf("rule %q needs either words or a pattern", rule.Name)
+		}
+		compiled := compiledRule{Rule: rule}
+		if rule.Pattern != "" {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+			}
+			compiled.re = re
+		}
+		compiled.phrases = map[string][][]string{}
+		for _, word := range rule.Words {
+			var phrase []string
+			for _, tok := range set.normalize.apply(word).tokens() {
+				phrase = append(phrase, tok.full)
+			}
+			if len(phrase) == 0 {
+				return nil, fmt.Errorf("rule %q has a word with no letters or digits: %q", rule.Name, word)
+			}
+			compiled.phrases[phrase[0]] = append(compiled.phrases[phrase[0]], phrase)
+		}
+		set.rules = append(set.rules, compiled)
+	}
+	return set, nil
+}
+
+// Apply filters text with the current rules.
+func (f *Filter) Apply(text string) Result {
+	f.mux.RLock()
+	set := f.set
+	f.mux.RUnlock()
+	folded := set.normalize.apply(text)
+	tokens := folded.tokens()
+	result := Result{Text: text}
+	var masks []Match
+	for _, rule := range set.rules {
+		for _, match := range rule.find(text, folded, tokens) {
+			switch rule.Action {
+			case Reject:
+				if result.Rejected == nil {
+					result.Rejected = &match
+				}
+			case Flag:
+				result.Flagged = append(result.Flagged, match)
+			case Mask:
+				masks = append(masks, match)
+			}
+		}
+	}
+	var spans []maskedSpan
+	result.Text, spans = set.mask(text, masks)
+	for i := range result.Flagged {
+		result.Flagged[i].remap(spans)
+	}
+	if result.Rejected != nil {
+		result.Rejected.remap(spans)
+	}
+	return result
+}
+func (rule compiledRule) match(start, end int) Match {
+	return Match{
+		Rule:        rule.Name,
+		Action:      rule.Action,
+		Reason:      rule.Reason,
+		Start:       start,
+		End:         end,
+		replacement: rule.Replacement,
+	}
+}
+func (rule compiledRule) find(text string, folded normalized, tokens []token) []Match {
+	var matches []Match
+	if rule.re != nil {
+		if !rule.Normalized {
+			for _, loc := range rule.re.FindAllStringIndex(text, -1) {
+				matches = append(matches, rule.match(loc[0], loc[1]))
+			}
+			return matches
+		}
+		for _, loc := range rule.re.FindAllStringIndex(folded.text, -1) {
+			if start, end, ok := folded.original(loc[0], loc[1]); ok {
+				matches = append(matches, rule.match(start, end))
+			}
+		}
+		return matches
+	}
+	for i, first := range tokens {
+		candidates := rule.phrases[first.full]
+		if first.trimmed != first.full {
+			candidates = append(candidates[:len(candidates):len(candidates)], rule.phrases[first.trimmed]...)
+		}
+		for _, phrase := range candidates {
+			if i+len(phrase) > len(tokens) {
+				continue
+			}
+			ok := true
+			for k, want := range phrase {
+				if tok := tokens[i+k]; tok.full != want && tok.trimmed != want {
+					ok = false
+					break
+				}
+			}
+			if !ok {
+				continue
+			}
+			last := tokens[i+len(phrase)-1]
+			from, to := first.from, last.to
+			if first.full != phrase[0] {
+				from = first.trimmedFrom
+			}
+			if last.full != phrase[len(phrase)-1] {
+				to = last.trimmedTo
+			}
+			matches = append(matches, rule.match(folded.spans[from].start, folded.spans[to-1].end))
+		}
+	}
+	return matches
+}
+
+// maskedSpan is where mask replaced text[start:end], which is
+// masked[newStart:newEnd] in the masked text.
+type maskedSpan struct {
+	start, end, newStart, newEnd int
+}
+
+// remap moves a match's offsets from the text that was filtered onto the
+// masked text, since a mask can be longer or shorter than what it hides.
+func (m *Match) remap(spans []maskedSpan) {
+	m.Start = remapOffset(spans, m.Start, false)
+	m.End = remapOffset(spans, m.End, true)
+}
+func remapOffset(spans []maskedSpan, pos int, end bool) int {
+	delta := 0
+	for _, span := range spans {
+		if pos <= span.start {
+			break
+		}
+		if pos >= span.end {
+			delta = span.newEnd - span.end
+			continue
+		}
+		if end {
+			return span.newEnd
+		}
+		return span.newStart
+	}
+	return pos + delta
+}
+
+// mask replaces every masked match in text, and reports where. Overlapping
+// matches are merged and masked character by character.
+func (set *ruleSet) mask(text string, masks []Match) (string, []maskedSpan) {
+	if len(masks) == 0 {
+		return text, nil
+	}
+	var spans []maskedSpan
+	sort.Slice(masks, func(i, j int) bool { return masks[i].Start < masks[j].Start })
+	var b strings.Builder
+	pos := 0
+	for i := 0; i < len(masks); i++ {
+		m := masks[i]
+		for i+1 < len(masks) && masks[i+1].Start < m.End {
+			i++
+			m.replacement = ""
+			if masks[i].End > m.End {
+				m.End = masks[i].End
+			}
+		}
+		b.WriteString(text[pos:m.Start])
+		span := maskedSpan{start: m.Start, end: m.End, newStart: b.Len()}
+		if m.replacement != "" {
+			b.WriteString(m.replacement)
+		} else {
+			b.WriteString(strings.Repeat(set.maskChar, utf8.RuneCountInString(text[m.Start:m.End])))
+		}
+		span.newEnd = b.Len()
+		spans = append(spans, span)
+		pos = m.End
+	}
+	b.WriteString(text[pos:])
+	return b.String(), spans
+}
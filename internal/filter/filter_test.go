@@ -0,0 +1,200 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newFilter(t *testing.T, cfg Config) *Filter {
+	t.Helper()
+	set, err := compile(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Filter{set: set}
+}
+
+func TestNormalizedMasking(t *testing.T) {
+	f := newFilter(t, DefaultConfig)
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"clean text", "hello world", "hello world"},
+		{"plain", "what a kerfuffle", "what a *********"},
+		{"upper case", "what a KERFUFFLE", "what a *********"},
+		{"trailing punctuation", "Kerfuffle! Really?", "*********! Really?"},
+		{"surrounding punctuation", "(kerfuffle)", "(*********)"},
+		{"Cyrillic look-alike", "what a kеrfuffle", "what a *********"},
+		{"Greek look-alike", "what a kerfuffιe", "what a *********"},
+		{"accents", "what a kérfüffle", "what a *********"},
+		{"full width", "ｋｅｒｆｕｆｆｌｅ", "*********"},
+		{"leetspeak", "what a k3rfuffl3", "what a *********"},
+		{"leetspeak symbols", "$harbert", "********"},
+		{"several words", "sharbert and fornax", "******** and ******"},
+		{"part of a longer word", "kerfufflement", "kerfufflement"},
+		{"split by punctuation", "ker.fuffle", "ker.fuffle"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := f.Apply(tt.text).Text; got != tt.want {
+				t.Errorf("Apply(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizationOff(t *testing.T) {
+	f := newFilter(t, Config{Rules: DefaultConfig.Rules})
+	for text, want := range map[string]string{
+		"kerfuffle":  "*********",
+		"Kerfuffle!": "Kerfuffle!",
+		"kеrfuffle":  "kеrfuffle",
+		"k3rfuffl3":  "k3rfuffl3",
+	} {
+		if got := f.Apply(text).Text; got != want {
+			t.Errorf("Apply(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestActions(t *testing.T) {
+	f := newFilter(t, Config{
+		Normalize: Normalization{CaseFold: true, Confusables: true, Leetspeak: true},
+		Rules: []Rule{
+			{Name: "giveaways", Words: []string{"free giveaway"}, Action: Flag},
+			{Name: "shorteners", Pattern: `(?i)bit\.ly/`, Action: Reject, Reason: "No shorteners"},
+			{Name: "digits", Pattern: `[0-9]{4}`, Action: Mask, Replacement: "[redacted]"},
+			{Name: "spam", Pattern: `spam`, Normalized: true, Action: Flag},
+		},
+	})
+	tests := []struct {
+		name        string
+		text        string
+		wantText    string
+		wantReject  string
+		wantFlagged []Match
+	}{
+		{
+			name:        "phrase across spaces and punctuation",
+			text:        "FREE   giveaway!!",
+			wantText:    "FREE   giveaway!!",
+			wantFlagged: []Match{{Rule: "giveaways", Action: Flag, Start: 0, End: 15}},
+		},
+		{
+			name:       "reject",
+			text:       "see Bit.ly/abc",
+			wantText:   "see Bit.ly/abc",
+			wantReject: "shorteners",
+		},
+		{
+			name:     "mask with a replacement",
+			text:     "pin 1234",
+			wantText: "pin [redacted]",
+		},
+		{
+			name:        "pattern on the normalized text maps back to the original",
+			text:        "say SPΑM",
+			wantText:    "say SPΑM",
+			wantFlagged: []Match{{Rule: "spam", Action: Flag, Start: 4, End: 9}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := f.Apply(tt.text)
+			if result.Text != tt.wantText {
+				t.Errorf("text = %q, want %q", result.Text, tt.wantText)
+			}
+			gotReject := ""
+			if result.Rejected != nil {
+				gotReject = result.Rejected.Rule
+			}
+			if gotReject != tt.wantReject {
+				t.Errorf("rejected by %q, want %q", gotReject, tt.wantReject)
+			}
+			if len(result.Flagged) != len(tt.wantFlagged) {
+				t.Fatalf("flagged = %+v, want %+v", result.Flagged, tt.wantFlagged)
+			}
+			for i, want := range tt.wantFlagged {
+				got := result.Flagged[i]
+				got.replacement = ""
+				if got != want {
+					t.Errorf("flag %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReloadKeepsRulesOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter.json")
+	write := func(config string) {
+		if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"rules": [{"name": "a", "words": ["apple"], "action": "mask"}]}`)
+	f, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, broken := range []string{
+		`{"rules": [{"name": "a", "words": ["apple"], "action": "eat"}]}`,
+		`{"rules": [{"name": "a", "pattern": "(", "action": "mask"}]}`,
+		`{"rules": [{"name": "a", "words": ["apple"], "action": "mask", "typo": 1}]}`,
+		`{"rules": [{"name": "a", "words": ["..."], "action": "mask"}]}`,
+		`not json`,
+	} {
+		write(broken)
+		if err := f.Reload(); err == nil {
+			t.Errorf("reloaded %s", broken)
+		}
+	}
+	if got := f.Apply("apple").Text; got != "*****" {
+		t.Errorf("after failed reloads Apply = %q, want the old rules", got)
+	}
+}
+
+func TestFlagOffsetsFollowMasks(t *testing.T) {
+	f := newFilter(t, Config{
+		Normalize: DefaultConfig.Normalize,
+		MaskChar:  "*",
+		Rules: []Rule{
+			{Name: "digits", Pattern: `[0-9]{4}`, Action: Mask, Replacement: "[redacted]"},
+			{Name: "short", Words: []string{"sharbert"}, Action: Mask, Replacement: "x"},
+			{Name: "profanity", Words: []string{"kerfuffle"}, Action: Mask},
+			{Name: "giveaways", Words: []string{"free giveaway"}, Action: Flag},
+			{Name: "pins", Pattern: `pin [0-9]{4}`, Action: Flag},
+		},
+	})
+	tests := []struct {
+		name string
+		text string
+		want []string // what each flag covers in the masked text
+	}{
+		{"after a longer replacement", "pin 1234 free giveaway", []string{"free giveaway", "pin [redacted]"}},
+		{"after a shorter replacement", "sharbert free giveaway", []string{"free giveaway"}},
+		{"after a multibyte word masked per character", "kérfüffle, free giveaway", []string{"free giveaway"}},
+		{"before a mask", "free giveaway 1234", []string{"free giveaway"}},
+		{"between masks", "1234 free giveaway sharbert", []string{"free giveaway"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := f.Apply(tt.text)
+			if len(result.Flagged) != len(tt.want) {
+				t.Fatalf("flagged = %+v, want %d", result.Flagged, len(tt.want))
+			}
+			for i, want := range tt.want {
+				m := result.Flagged[i]
+				if m.Start < 0 || m.End > len(result.Text) || m.Start > m.End {
+					t.Fatalf("flag %+v is outside %q", m, result.Text)
+				}
+				if got := result.Text[m.Start:m.End]; got != want {
+					t.Errorf("flag %d covers %q of %q, want %q", i, got, result.Text, want)
+				}
+			}
+		})
+	}
+}
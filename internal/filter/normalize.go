@@ -0,0 +1,159 @@
+package filter
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalization says how text is folded before word lists are matched.
+// Word lists go through the same folding, so both sides agree.
+type Normalization struct {
+	CaseFold    bool `json:"case_fold"`
+	Confusables bool `json:"confusables"`
+	Leetspeak   bool `json:"leetspeak"`
+}
+
+// confusables maps look-alike letters from other scripts to Latin. It
+// runs after case folding, so only lower case is listed.
+var confusables = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'һ': 'h', 'н': 'h', 'і': 'i', 'ј': 'j',
+	'к': 'k', 'ӏ': 'l', 'м': 'm', 'о': 'o', 'р': 'p', 'ԛ': 'q', 'с': 'c',
+	'ѕ': 's', 'т': 't', 'у': 'y', 'х': 'x', 'ԁ': 'd', 'ԝ': 'w',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v',
+	'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'ω': 'w', 'ı': 'i',
+}
+
+// leetspeak maps digits and symbols to the letters they stand in for.
+// Since 1 may stand for either i or l, l is folded to i as well.
+var leetspeak = map[rune]rune{
+	'0': 'o', '1': 'i', '!': 'i', '|': 'i', 'l': 'i', '3': 'e', '4': 'a',
+	'@': 'a', '5': 's', '$': 's', '7': 't', '+': 't', '8': 'b', '9': 'g',
+}
+
+func mapRunes(table map[rune]rune) func(rune) rune {
+	return func(r rune) rune {
+		if to, ok := table[r]; ok {
+			return to
+		}
+		return r
+	}
+}
+
+// normalized is a folded copy of a text that remembers, for every rune,
+// the bytes of the original it came from.
+type normalized struct {
+	text  string
+	spans []span
+	// runeAt maps byte offsets in text to indexes into spans.
+	runeAt []int
+}
+type span struct {
+	start, end int
+	// symbol is set for runes that were neither letters nor digits before
+	// leetspeak turned them into letters.
+	symbol bool
+}
+
+func (n Normalization) apply(text string) normalized {
+	var b strings.Builder
+	var out normalized
+	caser := cases.Fold()
+	for i := 0; i < len(text); {
+		r, width := utf8.DecodeRuneInString(text[i:])
+		folded := n.fold(r, caser)
+		if folded == "" && len(out.spans) > 0 {
+			out.spans[len(out.spans)-1].end = i + width
+		}
+		for _, f := range folded {
+			for range utf8.RuneLen(f) {
+				out.runeAt = append(out.runeAt, len(out.spans))
+			}
+			b.WriteRune(f)
+			out.spans = append(out.spans, span{start: i, end: i + width, symbol: !unicode.IsLetter(r) && !unicode.IsDigit(r)})
+		}
+		i += width
+	}
+	out.runeAt = append(out.runeAt, len(out.spans))
+	out.text = b.String()
+	return out
+}
+func (n Normalization) fold(r rune, caser cases.Caser) string {
+	s := string(r)
+	if n.Confusables {
+		s = strings.Map(func(r rune) rune {
+			if unicode.Is(unicode.Mn, r) {
+				return -1
+			}
+			return r
+		}, norm.NFKD.String(s))
+	}
+	if n.CaseFold {
+		s = caser.String(s)
+	}
+	if n.Confusables {
+		s = strings.Map(mapRunes(confusables), s)
+	}
+	if n.Leetspeak {
+		s = strings.Map(mapRunes(leetspeak), s)
+	}
+	return s
+}
+
+// original maps a byte range of the normalized text back onto the
+// original text.
+func (nt normalized) original(start, end int) (int, int, bool) {
+	from, to := nt.runeAt[start], nt.runeAt[end]
+	if from >= to {
+		return 0, 0, false
+	}
+	return nt.spans[from].start, nt.spans[to-1].end, true
+}
+
+// A token is a run of letters and digits in the normalized text, given as
+// indexes into its spans. trimmed is the token without symbols at either
+// end, so "kerfuffle!" is also tried as "kerfuffle" when leetspeak has
+// turned the ! into a letter.
+type token struct {
+	full, trimmed          string
+	from, to               int
+	trimmedFrom, trimmedTo int
+}
+
+func (nt normalized) tokens() []token {
+	var tokens []token
+	runes := []rune(nt.text)
+	for i := 0; i < len(runes); {
+		if !isWord(runes[i]) {
+			i++
+			continue
+		}
+		j := i + 1
+		for !unspaced(runes[i]) && j < len(runes) && isWord(runes[j]) && !unspaced(runes[j]) {
+			j++
+		}
+		tok := token{full: string(runes[i:j]), from: i, to: j, trimmedFrom: i, trimmedTo: j}
+		for tok.trimmedFrom < tok.trimmedTo && nt.spans[tok.trimmedFrom].symbol {
+			tok.trimmedFrom++
+		}
+		for tok.trimmedTo > tok.trimmedFrom && nt.spans[tok.trimmedTo-1].symbol {
+			tok.trimmedTo--
+		}
+		tok.trimmed = string(runes[tok.trimmedFrom:tok.trimmedTo])
+		tokens = append(tokens, tok)
+		i = j
+	}
+	return tokens
+}
+func isWord(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// unspaced reports runes of scripts written without spaces between words.
+// Each of them is a token of its own.
+func unspaced(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
@@ -0,0 +1,223 @@
+package keyring
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func load(t *testing.T, path, alg string, rotateEvery, verifyFor time.Duration) *Ring {
+	t.Helper()
+	ring, err := Load(path, alg, rotateEvery, verifyFor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+func sign(t *testing.T, ring *Ring) string {
+	t.Helper()
+	token, err := ring.Sign(jwt.RegisteredClaims{Subject: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func verify(ring *Ring, token string) error {
+	_, err := jwt.Parse(token, ring.Keyfunc, jwt.WithValidMethods(ring.Algs()))
+	return err
+}
+
+func TestMaintain(t *testing.T) {
+	const rotateEvery, verifyFor = 24 * time.Hour, time.Hour + 30*time.Second
+	path := filepath.Join(t.TempDir(), "keys.json")
+	ring := load(t, path, EdDSA, rotateEvery, verifyFor)
+	created := ring.active().CreatedAt
+	first := ring.active().Kid
+	oldToken := sign(t, ring)
+
+	steps := []struct {
+		name        string
+		after       time.Duration
+		wantRotated bool
+		wantKeys    int
+		wantOldOk   bool
+	}{
+		{"before rotation is due", time.Hour, false, 1, true},
+		{"rotation due", rotateEvery, true, 2, true},
+		{"retired key within the token lifetime", rotateEvery + verifyFor - time.Second, false, 2, true},
+		{"retired key past the token lifetime", rotateEvery + verifyFor, false, 1, false},
+	}
+	for _, step := range steps {
+		rotated, err := ring.Maintain(created.Add(step.after))
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if rotated != step.wantRotated || len(ring.keys) != step.wantKeys {
+			t.Errorf("%s: rotated %v with %d keys, want %v with %d", step.name, rotated, len(ring.keys), step.wantRotated, step.wantKeys)
+		}
+		if err := verify(ring, oldToken); (err == nil) != step.wantOldOk {
+			t.Errorf("%s: verifying a token of the first key = %v, want ok %v", step.name, err, step.wantOldOk)
+		}
+	}
+	if ring.active().Kid == first {
+		t.Error("the first key still signs after rotation")
+	}
+	if err := verify(ring, oldToken); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("token of a forgotten key = %v, want ErrUnknownKey", err)
+	}
+
+	reloaded := load(t, path, EdDSA, rotateEvery, verifyFor)
+	if len(reloaded.keys) != 1 || reloaded.active().Kid != ring.active().Kid {
+		t.Errorf("reloaded keys = %v, want only the rotated key", reloaded.keys)
+	}
+}
+
+func TestAlgorithmChangeRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	edToken := sign(t, load(t, path, EdDSA, 24*time.Hour, time.Hour))
+	ring := load(t, path, RS256, 24*time.Hour, time.Hour)
+	if got := ring.active().Alg; got != RS256 {
+		t.Errorf("signing key alg = %s, want RS256", got)
+	}
+	if err := verify(ring, edToken); err != nil {
+		t.Errorf("token of the retired EdDSA key = %v, want it still verified", err)
+	}
+	if err := verify(ring, sign(t, ring)); err != nil {
+		t.Errorf("token of the RS256 key = %v", err)
+	}
+}
+
+func TestKeyfunc(t *testing.T) {
+	ring := load(t, filepath.Join(t.TempDir(), "keys.json"), EdDSA, 24*time.Hour, time.Hour)
+	kid := ring.active().Kid
+	tests := []struct {
+		name    string
+		method  jwt.SigningMethod
+		kid     any
+		wantErr error
+	}{
+		{"known key", jwt.SigningMethodEdDSA, kid, nil},
+		{"unknown kid", jwt.SigningMethodEdDSA, "not-a-kid", ErrUnknownKey},
+		{"no kid", jwt.SigningMethodEdDSA, nil, ErrUnknownKey},
+		{"kid of another type", jwt.SigningMethodEdDSA, 42, ErrUnknownKey},
+		{"known key with the wrong alg", jwt.SigningMethodRS256, kid, ErrWrongAlg},
+		{"known key as an HMAC secret", jwt.SigningMethodHS256, kid, ErrWrongAlg},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := &jwt.Token{Method: tt.method, Header: map[string]any{"alg": tt.method.Alg()}}
+			if tt.kid != nil {
+				token.Header["kid"] = tt.kid
+			}
+			key, err := ring.Keyfunc(token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Keyfunc = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if _, ok := key.(ed25519.PublicKey); !ok {
+					t.Errorf("Keyfunc = %T, want the public key", key)
+				}
+			}
+		})
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	for _, alg := range []string{EdDSA, RS256} {
+		t.Run(alg, func(t *testing.T) {
+			ring := load(t, filepath.Join(t.TempDir(), "keys.json"), alg, 24*time.Hour, time.Hour)
+			set := ring.JWKS()
+			if len(set.Keys) != 1 {
+				t.Fatalf("JWKS has %d keys, want 1", len(set.Keys))
+			}
+			jwk := set.Keys[0]
+			if jwk.Kid != ring.active().Kid || jwk.Alg != alg || jwk.Use != "sig" {
+				t.Errorf("JWK = %+v, want kid %s, alg %s, use sig", jwk, ring.active().Kid, alg)
+			}
+			switch pub := ring.active().signer.Public().(type) {
+			case ed25519.PublicKey:
+				x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+				if jwk.Kty != "OKP" || jwk.Crv != "Ed25519" || err != nil || !pub.Equal(ed25519.PublicKey(x)) {
+					t.Errorf("JWK = %+v, want the OKP Ed25519 public key", jwk)
+				}
+				if jwk.N != "" || jwk.E != "" {
+					t.Errorf("JWK = %+v, want no RSA fields", jwk)
+				}
+			case *rsa.PublicKey:
+				n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+				e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+				if errN != nil || errE != nil {
+					t.Fatalf("JWK = %+v: %v, %v", jwk, errN, errE)
+				}
+				decoded := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+				if jwk.Kty != "RSA" || jwk.E != "AQAB" || !pub.Equal(decoded) {
+					t.Errorf("JWK = %+v, want the RSA public key", jwk)
+				}
+				if jwk.Crv != "" || jwk.X != "" {
+					t.Errorf("JWK = %+v, want no OKP fields", jwk)
+				}
+			}
+		})
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys.json")
+	ring := load(t, path, EdDSA, 24*time.Hour, time.Hour)
+	token := sign(t, ring)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("keyring mode = %v, want 0600", mode)
+	}
+	if leftovers, _ := filepath.Glob(path + ".tmp*"); len(leftovers) != 0 {
+		t.Errorf("temporary files left behind: %v", leftovers)
+	}
+
+	reloaded := load(t, path, EdDSA, 24*time.Hour, time.Hour)
+	if reloaded.active().Kid != ring.active().Kid {
+		t.Errorf("reloaded signing key %s, want %s", reloaded.active().Kid, ring.active().Kid)
+	}
+	if err := verify(reloaded, token); err != nil {
+		t.Errorf("token signed before reloading = %v", err)
+	}
+
+	pem := ring.active().PrivateKey
+	for name, contents := range map[string]string{
+		"not json":                "{",
+		"missing kid":             `{"keys": [{"alg": "EdDSA", "private_key": ` + quote(pem) + `}]}`,
+		"unsupported alg":         `{"keys": [{"kid": "a", "alg": "HS256", "private_key": ` + quote(pem) + `}]}`,
+		"alg of another key type": `{"keys": [{"kid": "a", "alg": "RS256", "private_key": ` + quote(pem) + `}]}`,
+		"not a PEM block":         `{"keys": [{"kid": "a", "alg": "EdDSA", "private_key": "secret"}]}`,
+	} {
+		bad := filepath.Join(dir, "bad.json")
+		if err := os.WriteFile(bad, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(bad, EdDSA, 24*time.Hour, time.Hour); err == nil {
+			t.Errorf("%s: loaded a broken keyring", name)
+		}
+	}
+	if _, err := Load(path, "HS256", 24*time.Hour, time.Hour); err == nil {
+		t.Error("loaded a keyring to sign with HS256")
+	}
+}
+
+func quote(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tekisatsu/chirpy/internal/database"
+)
+
+func (s *Server) likeChirp(w http.ResponseWriter, r *http.Request) {
+	s.changeLike(w, r, s.DB.LikeChirp)
+}
+func (s *Server) unlikeChirp(w http.ResponseWriter, r *http.Request) {
+	s.changeLike(w, r, s.DB.UnlikeChirp)
+}
+func (s *Server) changeLike(w http.ResponseWriter, r *http.Request, change func(chirpId, userId int) error) {
+	current, ok := currentUser(r)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+	userId := current.UserId
+	chirpId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid chirp id")
+		return
+	}
+	err = change(chirpId, userId)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Printf("Error changing like: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	chirp, err := s.DB.GetChirp(chirpId)
+	if err != nil {
+		log.Printf("Error getting Chirp: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	views, err := s.viewChirps(r, []database.Chirp{chirp})
+	if err != nil {
+		log.Printf("Error getting likes: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	respondWithJSON(w, 200, views[0])
+}
+func (s *Server) getUserLikes(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid user id")
+		return
+	}
+	chirps, err := s.DB.GetLikedChirps(userId)
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Printf("Error listing likes: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	views, err := s.viewChirps(r, chirps)
+	if err != nil {
+		log.Printf("Error getting likes: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	respondWithJSON(w, 200, views)
+}
@@ -1,256 +1,247 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/joho/godotenv"
+	"github.com/rivo/uniseg"
+	"github.com/tekisatsu/chirpy/internal/database"
+	"github.com/tekisatsu/chirpy/internal/filter"
+	"github.com/tekisatsu/chirpy/internal/keyring"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"time"
-	"github.com/go-chi/chi/v5"
-	"github.com/golang-jwt/jwt/v5"
-	"github.com/joho/godotenv"
-	"github.com/tekisatsu/chirpy/internal/database"
 )
+
 type Server struct {
-	DB *database.DB
+	DB        database.Store
 	apiConfig apiConfig
+	filter    *filter.Filter
+	trends    *trendTracker
 }
+
+const (
+	accessTokenTTL  = time.Hour
+	refreshTokenTTL = 60 * 24 * time.Hour
+)
+
 type apiConfig struct {
 	fileserverHits int
-	jwtSecret []byte
+	keys           *keyring.Ring
+	tokens         tokenValidator
+	restoreWindow  time.Duration
+	maxChirpLength int
+	adminToken     string
 }
-func (cfg *apiConfig) hitsCounter (next http.Handler) http.Handler {
+
+func (cfg *apiConfig) hitsCounter(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg.fileserverHits ++
-		next.ServeHTTP(w,r)
+		cfg.fileserverHits++
+		next.ServeHTTP(w, r)
 	})
 }
-func (cfg *apiConfig) resetHitsCounter () http.Handler {
+func (cfg *apiConfig) resetHitsCounter() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		cfg.fileserverHits = 0
-	}) 
+	})
 }
-func (cfg *apiConfig) createAccessToken (id int) (string,error) {
-	var expirationSeconds int = 3600 //one hour
-	claims := &jwt.RegisteredClaims{
-		Subject: strconv.Itoa(id),
-		IssuedAt: jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Duration(expirationSeconds)*time.Second)),
-		Issuer: "chirpy-access",
+func (cfg *apiConfig) createAccessToken(id int, sessionId string) (string, error) {
+	claims := &accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(id),
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(accessTokenTTL)),
+			Issuer:    accessTokenKind.issuer,
+			Audience:  jwt.ClaimStrings{accessTokenKind.audience},
+		},
+		SessionId: sessionId,
+		Scope:     strings.Join(loginScopes, " "),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256,claims)
-	signedToken,err := token.SignedString(cfg.jwtSecret)
+	signedToken, err := cfg.keys.Sign(claims)
 	if err != nil {
-		return "",err
+		return "", err
 	}
-	return signedToken,nil
+	return signedToken, nil
 }
-func (cfg *apiConfig) createRefreshToken (id int) (string,error) {
-	var expirationSeconds int = 86400*60 //60 days
-	claims := &jwt.RegisteredClaims{
-		Subject: strconv.Itoa(id),
-		IssuedAt: jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Duration(expirationSeconds)*time.Second)),
-		Issuer: "chirpy-refresh",
+
+// securityEvent logs something an operator should look into, such as a
+// stolen token being used.
+func securityEvent(format string, args ...any) {
+	log.Printf("Security: "+format, args...)
+}
+func (s *Server) tokenRefresh(w http.ResponseWriter, r *http.Request) {
+	tokenStr, err := bearerToken(r)
+	if err != nil {
+		respondAuthError(w, err)
+		return
+	}
+	refreshToken, err := s.DB.RotateRefreshToken(tokenStr, refreshTokenTTL, clientOf(r))
+	var reuse *database.TokenReuseError
+	if errors.As(err, &reuse) {
+		securityEvent("refresh token reused for user %d, revoked family %s", reuse.UserId, reuse.FamilyId)
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256,claims)
-	signedToken,err := token.SignedString(cfg.jwtSecret)
 	if err != nil {
-		return "",err
+		respondAuthError(w, err)
+		return
 	}
-	return signedToken,nil
-}
-func (cfg *apiConfig)validateToken(tokenStr string) (*jwt.Token,error) {
-	claims := &jwt.RegisteredClaims{}
-	var secretKey = cfg.jwtSecret
-	token,err := jwt.ParseWithClaims(tokenStr,claims,func(token *jwt.Token)(interface{},error){
-		return secretKey,nil
-	})
+	newToken, err := s.apiConfig.createAccessToken(refreshToken.UserId, refreshToken.FamilyId)
 	if err != nil {
-		return nil,err
+		log.Printf("Error creating token: %v", err)
+		w.WriteHeader(500)
+		return
 	}
-	if !token.Valid {
-		return nil, errors.New("Expired token")
+	result := struct {
+		AccessToken  string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{AccessToken: newToken, RefreshToken: refreshToken.Token}
+	dat, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %v", err)
+		w.WriteHeader(500)
+		return
 	}
-	return token,nil
+	w.Header().Set("Content-type", "Application/json")
+	w.WriteHeader(200)
+	w.Write(dat)
 }
-func (s *Server)tokenRefresh(w http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")	
-	tokenStr := strings.TrimPrefix(authHeader,"Bearer ")
-	token,err := s.apiConfig.validateToken(tokenStr)
+func (s *Server) revokeToken(w http.ResponseWriter, r *http.Request) {
+	tokenStr, err := bearerToken(r)
 	if err != nil {
-		log.Printf("Invalid token: %e",err)
-		w.WriteHeader(401)
+		respondAuthError(w, err)
 		return
-	} else {
-		claims,ok := token.Claims.(*jwt.RegisteredClaims)
-		if !ok {
-			log.Printf("Error getting Claims")
-			w.WriteHeader(500)
-			return
-		}
-		if claims.Issuer != "chirpy-refresh" {
-			log.Printf("Invalid issuer")
-			w.WriteHeader(401)
-			return
-		}
-		err := s.DB.RefreshToken(tokenStr)
-		if err != nil {
-			log.Printf("Invalid token: %v",err)
-			w.WriteHeader(401)
-			return
-		}
-		id,err := strconv.Atoi(claims.Subject)
-		if err != nil {
-			log.Printf("Error getting id: %v",err)
-			w.WriteHeader(500)
-			return
-		}
-		newToken,err := s.apiConfig.createAccessToken(id)
-		if err != nil {
-			log.Printf("Error creating token: %v",err)
-			w.WriteHeader(500)
-			return
-		}
-		result := struct{
-			AccessToken string `json:"token"`
-		}{AccessToken: newToken}
-		dat, err := json.Marshal(result)
-		if err != nil {
-			log.Printf("Error marshalling JSON: %v",err)
-			w.WriteHeader(500)
-			return
-		}
-		w.Header().Set("Content-type","Application/json")
-		w.WriteHeader(200)
-		w.Write(dat)
 	}
-}
-func (s *Server)revokeToken(w http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")	
-	tokenStr := strings.TrimPrefix(authHeader,"Bearer ")
-	token,err := s.apiConfig.validateToken(tokenStr)
+	err = s.DB.RevokeRefreshToken(tokenStr)
 	if err != nil {
-		log.Printf("Invalid token: %e",err)
-		w.WriteHeader(401)
+		respondAuthError(w, err)
 		return
-	} else {
-		claims,ok := token.Claims.(*jwt.RegisteredClaims)
-		if !ok {
-			log.Printf("Error getting Claims")
-			w.WriteHeader(500)
-			return
-		}
-		if claims.Issuer != "chirpy-refresh" {
-			log.Printf("Invalid issuer")
-			w.WriteHeader(401)
-			return
-		}
-		err := s.DB.RevokeRefreshToken(tokenStr)
-		if err != nil {
-			log.Printf("Error revoking token: %v",err)
-			w.WriteHeader(401)
-			return
-		}
-		w.WriteHeader(200)
 	}
+	w.WriteHeader(200)
 }
-func (s *Server)createUser(w http.ResponseWriter, r *http.Request) {
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
 	type parameter struct {
-		Email string `json:"email"`
+		Email    string `json:"email"`
 		Password string `json:"password"`
+		Handle   string `json:"handle"`
 	}
 	defer r.Body.Close()
 	decoder := json.NewDecoder(r.Body)
 	params := parameter{}
 	err := decoder.Decode(&params)
 	if err != nil {
-		log.Printf("Error decoding params: %v",err)
+		log.Printf("Error decoding params: %v", err)
 		w.WriteHeader(500)
 		return
 	} else {
-		newUser,err := s.DB.CreateUser(params.Email,params.Password)
+		newUser, err := s.DB.CreateUser(params.Email, params.Password, strings.TrimPrefix(params.Handle, "@"))
+		if errors.Is(err, database.ErrInvalidHandle) {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+		if errors.Is(err, database.ErrEmailTaken) || errors.Is(err, database.ErrHandleTaken) {
+			respondWithError(w, 409, err.Error())
+			return
+		}
 		if err != nil {
-			log.Printf("Error creating user: %v",err)
+			log.Printf("Error creating user: %v", err)
 			w.WriteHeader(500)
 			return
 		}
-		dat,errM := json.Marshal(newUser)
+		dat, errM := json.Marshal(newUser)
 		if errM != nil {
-			log.Printf("Error marshalling user: %v",errM)
+			log.Printf("Error marshalling user: %v", errM)
 			w.WriteHeader(500)
 			return
 		}
-		w.Header().Set("Content-type","application/json")
+		w.Header().Set("Content-type", "application/json")
 		w.WriteHeader(201)
 		w.Write(dat)
 	}
-	
+
 }
-func (s *Server)updateUsers(w http.ResponseWriter, r *http.Request){
-	type parameter struct{
-		Email string `json:"email"`
-		Password string `json:"password"`
+
+// updateUsers changes only the fields the request supplies, for PUT and
+// PATCH alike. A new password needs current_password as well.
+func (s *Server) updateUsers(w http.ResponseWriter, r *http.Request) {
+	type parameter struct {
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+		Handle          *string `json:"handle"`
+		DisplayName     *string `json:"display_name"`
+		Bio             *string `json:"bio"`
+		AvatarURL       *string `json:"avatar_url"`
 	}
 	params := parameter{}
-	authHeader := r.Header.Get("Authorization")
-	tokenStr := strings.TrimPrefix(authHeader,"Bearer ")
 	defer r.Body.Close()
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&params)
 	if err != nil {
-		log.Printf("Error decoding params: %v",err)
+		log.Printf("Error decoding params: %v", err)
 		w.WriteHeader(500)
 		return
 	}
-	token,err := s.apiConfig.validateToken(tokenStr)
-	if err != nil {
-		log.Printf("Invalid token: %e",err)
-		w.WriteHeader(401)
+	current, ok := currentUser(r)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+	id := current.UserId
+	if params.Handle != nil {
+		handle := strings.TrimPrefix(*params.Handle, "@")
+		params.Handle = &handle
+	}
+	updatedUser, errU := s.DB.UpdateUser(id, database.UserUpdate{
+		Email:           params.Email,
+		Password:        params.Password,
+		CurrentPassword: params.CurrentPassword,
+		Handle:          params.Handle,
+		DisplayName:     params.DisplayName,
+		Bio:             params.Bio,
+		AvatarURL:       params.AvatarURL,
+	})
+	if isInvalidUpdate(errU) {
+		respondWithError(w, 400, errU.Error())
 		return
-	} else {
-		claims,ok := token.Claims.(*jwt.RegisteredClaims)
-		if !ok {
-			log.Printf("Error getting Claims")
-			w.WriteHeader(500)
-			return
-		}
-		if claims.Issuer != "chirpy-access" {
-			log.Printf("Invalid issuer")
-			w.WriteHeader(401)
-			return
-			}
-		id,err := strconv.Atoi(claims.Subject)
-		if err != nil {
-			log.Printf("Error converting subject to id: %e",err)
-			w.WriteHeader(500)
-			return
-		}
-		updatedUser,errU :=s.DB.UpdateUser(params.Email,params.Password,id)
-		if errU != nil {
-			log.Printf("Error updating user: %e",errU)
-			w.WriteHeader(500)
-			return
-		}
-		dat,errM := json.Marshal(updatedUser)
-		if errM != nil {
-			log.Printf("Error marshalling JSON: %e",errM)
-			w.WriteHeader(500)
-			return
-		}
-		w.Header().Set("Content-type","application/json")
-		w.WriteHeader(200)
-		w.Write(dat)
 	}
+	if errors.Is(errU, database.ErrWrongPassword) {
+		respondWithError(w, 403, errU.Error())
+		return
+	}
+	if errors.Is(errU, database.ErrEmailTaken) || errors.Is(errU, database.ErrHandleTaken) {
+		respondWithError(w, 409, errU.Error())
+		return
+	}
+	if errors.Is(errU, database.ErrUserNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if errU != nil {
+		log.Printf("Error updating user: %e", errU)
+		w.WriteHeader(500)
+		return
+	}
+	dat, errM := json.Marshal(updatedUser)
+	if errM != nil {
+		log.Printf("Error marshalling JSON: %e", errM)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(200)
+	w.Write(dat)
 }
-func (s *Server)userLogin(w http.ResponseWriter, r *http.Request) {
+func (s *Server) userLogin(w http.ResponseWriter, r *http.Request) {
 	type parameter struct {
-		Email string `json:"email"`
+		Email    string `json:"email"`
 		Password string `json:"password"`
 	}
 	defer r.Body.Close()
@@ -258,196 +249,528 @@ func (s *Server)userLogin(w http.ResponseWriter, r *http.Request) {
 	params := parameter{}
 	err := decoder.Decode(&params)
 	if err != nil {
-		log.Printf("Error decoding params: %v",err)
+		log.Printf("Error decoding params: %v", err)
 		w.WriteHeader(500)
 		return
-	}else{
-		valid,errV := s.DB.UserLogin(params.Email,params.Password)
+	} else {
+		valid, errV := s.DB.UserLogin(params.Email, params.Password)
 		if errV != nil {
-			log.Printf("Error validating: %v",errV)
+			log.Printf("Error validating: %v", errV)
 			w.WriteHeader(401)
 			return
 		}
-		accessToken,err := s.apiConfig.createAccessToken(valid.Id)
-		refreshToken, err := s.apiConfig.createRefreshToken(valid.Id)
+		refreshToken, err := s.DB.IssueRefreshToken(valid.Id, refreshTokenTTL, clientOf(r))
 		if err != nil {
-			log.Printf("Error creating token: %v",err)
+			log.Printf("Error creating token: %v", err)
+			w.WriteHeader(500)
+			return
+		}
+		accessToken, err := s.apiConfig.createAccessToken(valid.Id, refreshToken.FamilyId)
+		if err != nil {
+			log.Printf("Error creating token: %v", err)
 			w.WriteHeader(500)
 			return
 		}
 		type resp struct {
-			AccessToken string `json:"token"`
+			AccessToken  string `json:"token"`
 			RefreshToken string `json:"refresh_token"`
-			Email string `json:"email"`
-			Id int `json:"id"`
+			Email        string `json:"email"`
+			Handle       string `json:"handle"`
+			Id           int    `json:"id"`
 		}
-		respToken:= resp{
-			AccessToken: accessToken,
-			RefreshToken: refreshToken,
-			Email: valid.Email,
-			Id: valid.Id,
+		respToken := resp{
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken.Token,
+			Email:        valid.Email,
+			Handle:       valid.Handle,
+			Id:           valid.Id,
 		}
-		dat,errM := json.Marshal(respToken)
+		dat, errM := json.Marshal(respToken)
 		if errM != nil {
-			log.Printf("Error Marshalling JSON: %v",errM)
+			log.Printf("Error Marshalling JSON: %v", errM)
 			w.WriteHeader(500)
 			return
 		}
-		w.Header().Set("Content-type","application/json")
+		w.Header().Set("Content-type", "application/json")
 		w.WriteHeader(200)
 		w.Write(dat)
 	}
 }
-func (s *Server)deleteChirps(w http.ResponseWriter, r *http.Request){
-	authHeader := r.Header.Get("Authorization")	
-	tokenStr := strings.TrimPrefix(authHeader,"Bearer ")
-	token,err := s.apiConfig.validateToken(tokenStr)
+func (s *Server) deleteChirps(w http.ResponseWriter, r *http.Request) {
+	current, ok := currentUser(r)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+	authorId := current.UserId
+	idParam, errC := strconv.Atoi(chi.URLParam(r, "id"))
+	if errC != nil {
+		log.Printf("Error converting URLParam to int: %v", errC)
+		return
+	}
+	old, _ := s.DB.GetChirp(idParam)
+	errD := s.DB.DeleteChirp(idParam, authorId)
+	if errors.Is(errD, database.ErrChirpNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if errD != nil {
+		log.Printf("Error deleting Chirp: %e", errD)
+		w.WriteHeader(403)
+		return
+	}
+	s.trends.remove(old, time.Now())
+	w.WriteHeader(200)
+	return
+}
+func (s *Server) restoreChirp(w http.ResponseWriter, r *http.Request) {
+	current, ok := currentUser(r)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+	authorId := current.UserId
+	idParam, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		log.Printf("Invalid token: %e",err)
-		w.WriteHeader(401)
+		log.Printf("Error converting URLParam to int: %v", err)
+		w.WriteHeader(400)
 		return
-	} else {
-		idParam,errC := strconv.Atoi(chi.URLParam(r,"id"))
-		if errC != nil {
-			log.Printf("Error converting URLParam to int: %v",errC)
-			return
+	}
+	chirp, err := s.DB.RestoreChirp(idParam, authorId, s.apiConfig.restoreWindow)
+	switch {
+	case errors.Is(err, database.ErrChirpNotFound):
+		w.WriteHeader(404)
+		return
+	case errors.Is(err, database.ErrIdMismatch):
+		w.WriteHeader(403)
+		return
+	case errors.Is(err, database.ErrRestoreExpired):
+		w.WriteHeader(410)
+		return
+	case errors.Is(err, database.ErrAlreadyRechirped):
+		respondWithError(w, 409, err.Error())
+		return
+	case err != nil:
+		log.Printf("Error restoring Chirp: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	s.trends.add(chirp, time.Now())
+	views, err := s.viewChirps(r, []database.Chirp{chirp})
+	if err != nil {
+		log.Printf("Error viewing Chirp: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	respondWithJSON(w, 200, views[0])
+}
+func (s *Server) purgeDeletedChirps(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := s.DB.PurgeChirps(time.Now().Add(-s.apiConfig.restoreWindow))
+		if err != nil {
+			log.Printf("Error purging deleted Chirps: %v", err)
+			continue
 		}
-		claims,ok := token.Claims.(*jwt.RegisteredClaims)
-		if !ok {
-			log.Printf("Error getting Claims")
-			w.WriteHeader(500)
-			return
+		if n > 0 {
+			log.Printf("Purged %d deleted Chirps", n)
 		}
-		authorId,errI := strconv.Atoi(claims.Subject)
-		if errI != nil {
-			log.Printf("Error getting author id: %v",err)
-			w.WriteHeader(500)
-			return
+	}
+}
+func (s *Server) purgeRefreshTokens(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := s.DB.PurgeRefreshTokens(time.Now())
+		if err != nil {
+			log.Printf("Error purging refresh tokens: %v", err)
+			continue
 		}
-		errD := s.DB.DeleteChirp(idParam,authorId)
-		if errD != nil {
-			log.Printf("Error deleting Chirp: %e",errD)
-			w.WriteHeader(403)
-			return
+		if n > 0 {
+			log.Printf("Purged %d expired refresh tokens", n)
 		}
-		w.WriteHeader(200)
+	}
+}
+func (s *Server) rotateKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		rotated, err := s.apiConfig.keys.Maintain(time.Now())
+		if err != nil {
+			log.Printf("Error rotating signing keys: %v", err)
+			continue
+		}
+		if rotated {
+			log.Printf("Rotated the signing key")
+		}
+	}
+}
+
+// getJWKS publishes the keys access tokens can be verified with.
+func (s *Server) getJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, 200, s.apiConfig.keys.JWKS())
+}
+func (s *Server) postChirps(w http.ResponseWriter, r *http.Request) {
+	type parameter struct {
+		Body      string `json:"body"`
+		InReplyTo int    `json:"in_reply_to"`
+		QuoteOf   int    `json:"quote_of"`
+	}
+	current, ok := currentUser(r)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+	authorId := current.UserId
+	defer r.Body.Close()
+	decoder := json.NewDecoder(r.Body)
+	params := parameter{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameter %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	filtered, ok := s.filterChirp(w, params.Body)
+	if !ok {
+		return
+	}
+	if !s.checkChirpLength(w, filtered.Text) {
+		return
+	}
+	newChirp, err := s.DB.CreateChirp(filtered.Text, authorId, params.InReplyTo, params.QuoteOf)
+	if errors.Is(err, database.ErrParentNotFound) {
+		respondWithError(w, 400, fmt.Sprintf("in_reply_to: chirp %d does not exist", params.InReplyTo))
+		return
+	}
+	if errors.Is(err, database.ErrOriginalNotFound) {
+		respondWithError(w, 400, fmt.Sprintf("quote_of: chirp %d does not exist", params.QuoteOf))
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating Chirp: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	s.flagChirp(newChirp.Id, filtered.Flagged)
+	s.trends.add(newChirp, time.Now())
+	views, err := s.viewChirps(r, []database.Chirp{newChirp})
+	if err != nil {
+		log.Printf("Error viewing Chirp: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	dat, err := json.Marshal(views[0])
+	if err != nil {
+		log.Printf("Error marshaling json: %v", err)
+		w.WriteHeader(500)
 		return
 	}
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(201)
+	w.Write(dat)
 }
-func (s *Server)postChirps(w http.ResponseWriter, r *http.Request) {
+func (s *Server) updateChirp(w http.ResponseWriter, r *http.Request) {
 	type parameter struct {
 		Body string `json:"body"`
 	}
-	authHeader := r.Header.Get("Authorization")	
-	tokenStr := strings.TrimPrefix(authHeader,"Bearer ")
-	token,err := s.apiConfig.validateToken(tokenStr)
+	current, ok := currentUser(r)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+	authorId := current.UserId
+	idParam, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		log.Printf("Invalid token: %e",err)
-		w.WriteHeader(401)
+		log.Printf("Error converting URLParam to int: %v", err)
+		w.WriteHeader(400)
 		return
-	} else {
-		claims,ok := token.Claims.(*jwt.RegisteredClaims)
-		if !ok {
-			log.Printf("Error getting Claims")
-			w.WriteHeader(500)
-			return
+	}
+	defer r.Body.Close()
+	decoder := json.NewDecoder(r.Body)
+	params := parameter{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameter %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	filtered, ok := s.filterChirp(w, params.Body)
+	if !ok {
+		return
+	}
+	if !s.checkChirpLength(w, filtered.Text) {
+		return
+	}
+	old, _ := s.DB.GetChirp(idParam)
+	chirp, err := s.DB.UpdateChirp(idParam, authorId, filtered.Text)
+	switch {
+	case errors.Is(err, database.ErrChirpNotFound):
+		w.WriteHeader(404)
+		return
+	case errors.Is(err, database.ErrRechirpEdit):
+		respondWithError(w, 400, err.Error())
+		return
+	case errors.Is(err, database.ErrIdMismatch):
+		w.WriteHeader(403)
+		return
+	case err != nil:
+		log.Printf("Error updating Chirp: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	s.flagChirp(chirp.Id, filtered.Flagged)
+	now := time.Now()
+	s.trends.remove(old, now)
+	s.trends.add(chirp, now)
+	views, err := s.viewChirps(r, []database.Chirp{chirp})
+	if err != nil {
+		log.Printf("Error viewing Chirp: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	respondWithJSON(w, 200, views[0])
+}
+
+// checkChirpLength counts body in grapheme clusters, so an emoji or a
+// character with combining marks is one character however many bytes it
+// takes. It writes the 400 and reports false when body is too long.
+// Handlers check the filtered body, which is what gets stored, as a mask
+// can be longer than what it hides.
+func (s *Server) checkChirpLength(w http.ResponseWriter, body string) bool {
+	length := uniseg.GraphemeClusterCount(body)
+	if length <= s.apiConfig.maxChirpLength {
+		return true
+	}
+	respondWithJSON(w, 400, struct {
+		Error     string `json:"error"`
+		Length    int    `json:"length"`
+		MaxLength int    `json:"max_length"`
+	}{Error: "Chirp is too long", Length: length, MaxLength: s.apiConfig.maxChirpLength})
+	return false
+}
+func (s *Server) getChirpHistory(w http.ResponseWriter, r *http.Request) {
+	idParam, errC := strconv.Atoi(chi.URLParam(r, "id"))
+	if errC != nil {
+		log.Printf("Error converting URLParam to int: %v", errC)
+		w.WriteHeader(400)
+		return
+	}
+	revisions, err := s.DB.GetChirpHistory(idParam)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting Chirp history: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	dat, errM := json.Marshal(revisions)
+	if errM != nil {
+		log.Printf("Error marshalling Chirp history: %v", errM)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+const (
+	defaultChirpPageSize = 50
+	maxChirpPageSize     = 200
+)
+
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
+func decodeCursor(cursor string) (int, error) {
+	dat, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(dat))
+}
+func parseChirpQuery(r *http.Request) (database.ChirpQuery, error) {
+	query := r.URL.Query()
+	q := database.ChirpQuery{Limit: defaultChirpPageSize}
+	var err error
+	if v := query.Get("author_id"); v != "" {
+		if q.AuthorId, err = strconv.Atoi(v); err != nil {
+			return q, fmt.Errorf("Invalid author_id %q", v)
 		}
-		authorId,errI := strconv.Atoi(claims.Subject)
-		if errI != nil {
-			log.Printf("Error getting author id: %v",err)
-			w.WriteHeader(500)
-			return
+	}
+	switch query.Get("sort") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("Invalid sort %q, expected asc or desc", query.Get("sort"))
+	}
+	if v := query.Get("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("Invalid since %q, expected an RFC 3339 time", v)
 		}
-		defer r.Body.Close()
-		decoder := json.NewDecoder(r.Body)
-		params := parameter{}
-		err := decoder.Decode(&params)
-		if err != nil {
-			log.Printf("Error decoding parameter %s", err)
-			w.WriteHeader(500)
-			return
+	}
+	if v := query.Get("until"); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("Invalid until %q, expected an RFC 3339 time", v)
 		}
-		if len(params.Body) > 140 {
-			dat, err := json.Marshal("Error: Chirp too long")
-			if err != nil {
-				log.Printf("Error marshalling JSON %s",err)
-				w.WriteHeader(500)
-				return
-			}
-			w.Header().Set("Content-type","application/json")
-			w.WriteHeader(400)
-			w.Write(dat)
-		}else{
-			cf := chirpFilter(&params.Body)
-			newChirp,err := s.DB.CreateChirp(cf,authorId)
-			if err != nil {
-				log.Printf("Error creating Chirp: %s",err)
-				w.WriteHeader(500)
-				return
-			}
-			dat,err := json.Marshal(newChirp)
-			if err != nil {
-				log.Printf("Error marshaling json: %v",err)
-				w.WriteHeader(500)
-				return
-			}
-			w.Header().Set("Content-type","application/json")
-			w.WriteHeader(201)
-			w.Write(dat)
-	}	}
-}
-func chirpFilter (msg *string) string {
-	splitMsg := strings.Split(*msg," ")
-	for i,word := range splitMsg {
-		switch {
-		case strings.ToLower(word) == "kerfuffle": splitMsg[i]="****"
-		case strings.ToLower(word) == "sharbert": splitMsg[i]="****"
-		case strings.ToLower(word) == "fornax": splitMsg[i]="****"
+	}
+	if v := query.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > maxChirpPageSize {
+			return q, fmt.Errorf("Invalid limit %q, expected 1 to %d", v, maxChirpPageSize)
 		}
 	}
-	return strings.Join(splitMsg," ")
+	if v := query.Get("cursor"); v != "" {
+		if q.After, err = decodeCursor(v); err != nil {
+			return q, fmt.Errorf("Invalid cursor")
+		}
+	}
+	return q, nil
+}
+
+type chirpPage struct {
+	Chirps []chirpView `json:"chirps"`
+	Next   string      `json:"next,omitempty"`
+}
+
+// pageChirps fetches one more chirp than the page holds to learn whether
+// there is a next page.
+func (s *Server) pageChirps(r *http.Request, q database.ChirpQuery) (chirpPage, error) {
+	limit := q.Limit
+	q.Limit++
+	chirps, err := s.DB.GetChirps(q)
+	if err != nil {
+		return chirpPage{}, err
+	}
+	page := chirpPage{}
+	if len(chirps) > limit {
+		chirps = chirps[:limit]
+		page.Next = encodeCursor(chirps[limit-1].Id)
+	}
+	page.Chirps, err = s.viewChirps(r, chirps)
+	return page, err
 }
-func (s *Server) getChirps (w http.ResponseWriter,r *http.Request) {
-	chirps,err := s.DB.GetChirps()
+func (s *Server) getChirps(w http.ResponseWriter, r *http.Request) {
+	q, err := parseChirpQuery(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	page, err := s.pageChirps(r, q)
 	if err != nil {
-		log.Printf("Error getting Chirps: %v",err)
+		log.Printf("Error getting Chirps: %v", err)
 		w.WriteHeader(500)
 		return
 	}
-	dat,errM := json.Marshal(chirps)
-	if errM != nil {
-		log.Printf("Error marshalling Chirps: %v",errM)
+	respondWithJSON(w, 200, page)
+}
+func (s *Server) searchChirps(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := database.SearchQuery{Text: query.Get("q"), Limit: defaultChirpPageSize}
+	switch query.Get("sort") {
+	case "", "relevance":
+	case "recent":
+		q.ByRecency = true
+	default:
+		respondWithError(w, 400, fmt.Sprintf("Invalid sort %q, expected relevance or recent", query.Get("sort")))
 		return
 	}
-	w.Header().Set("Content-type","application/json")
-	w.WriteHeader(200)
-	w.Write(dat)
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxChirpPageSize {
+			respondWithError(w, 400, fmt.Sprintf("Invalid limit %q, expected 1 to %d", v, maxChirpPageSize))
+			return
+		}
+		q.Limit = limit
+	}
+	chirps, err := s.DB.SearchChirps(q)
+	if errors.Is(err, database.ErrEmptySearch) {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error searching Chirps: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	views, err := s.viewChirps(r, chirps)
+	if err != nil {
+		log.Printf("Error getting likes: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	respondWithJSON(w, 200, chirpPage{Chirps: views})
+}
+func (s *Server) getThread(w http.ResponseWriter, r *http.Request) {
+	idParam, errC := strconv.Atoi(chi.URLParam(r, "id"))
+	if errC != nil {
+		respondWithError(w, 400, "Invalid chirp id")
+		return
+	}
+	thread, err := s.DB.GetThread(idParam)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting thread: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	respondWithJSON(w, 200, thread)
 }
-func (s *Server) getChirp (w http.ResponseWriter,r *http.Request) {
-	idParam,errC := strconv.Atoi(chi.URLParam(r,"id"))
+func (s *Server) getChirp(w http.ResponseWriter, r *http.Request) {
+	idParam, errC := strconv.Atoi(chi.URLParam(r, "id"))
 	if errC != nil {
-		log.Printf("Error converting URLParam to int: %v",errC)
+		log.Printf("Error converting URLParam to int: %v", errC)
 		return
 	}
-	chirp,err := s.DB.GetChirp(idParam)
+	chirp, err := s.DB.GetChirp(idParam)
 	if err != nil {
-		log.Printf("%v",err)
+		log.Printf("%v", err)
 		w.WriteHeader(404)
 		return
 	}
-	dat,errM := json.Marshal(chirp)
+	views, errL := s.viewChirps(r, []database.Chirp{chirp})
+	if errL != nil {
+		log.Printf("Error getting likes: %v", errL)
+		w.WriteHeader(500)
+		return
+	}
+	dat, errM := json.Marshal(views[0])
 	if errM != nil {
-		log.Printf("Error mashalling Chirp: %v",err)
+		log.Printf("Error mashalling Chirp: %v", err)
 		return
 	}
-	w.Header().Set("Content-type","Application/json")
+	w.Header().Set("Content-type", "Application/json")
 	w.WriteHeader(200)
 	w.Write(dat)
 }
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	dat, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(code)
+	w.Write(dat)
+}
+func respondWithError(w http.ResponseWriter, code int, msg string) {
+	respondWithJSON(w, code, struct {
+		Error string `json:"error"`
+	}{Error: msg})
+}
 func middlewareCors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, PATCH, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -456,51 +779,206 @@ func middlewareCors(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
-func main () {
-	godotenv.Load()
-	jwtsecret := []byte(os.Getenv("JWT_SECRET"))
-	db, err := database.NewDb("database.json")
+func defaultDbPath(backend string) string {
+	if backend == "sqlite" {
+		return "database.sqlite"
+	}
+	return "database.json"
+}
+func openStore(backend, path string) (database.Store, error) {
+	if path == "" {
+		path = defaultDbPath(backend)
+	}
+	switch backend {
+	case "json":
+		return database.NewDb(path)
+	case "sqlite":
+		return database.NewSQLiteDb(path)
+	case "memory":
+		return database.NewMemDb(), nil
+	}
+	return nil, fmt.Errorf("Unknown storage backend %q", backend)
+}
+func migrateCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbBackend := fs.String("db", "json", "storage backend: json or sqlite")
+	dbPath := fs.String("dbpath", "", "path of the database file (default database.json or database.sqlite)")
+	dryRun := fs.Bool("dry-run", false, "list pending migrations without applying them")
+	fs.Parse(args)
+	if *dbPath == "" {
+		*dbPath = defaultDbPath(*dbBackend)
+	}
+	var applied []string
+	var err error
+	switch *dbBackend {
+	case "json":
+		applied, err = database.MigrateFile(*dbPath, *dryRun)
+	case "sqlite":
+		applied, err = database.MigrateSQLite(*dbPath, *dryRun)
+	default:
+		return fmt.Errorf("Unknown storage backend %q", *dbBackend)
+	}
 	if err != nil {
-		log.Fatalf("Failed to connect to DB: %v",err)
+		return err
 	}
-	apiCfg := apiConfig{
-		jwtSecret: jwtsecret,
+	if len(applied) == 0 {
+		fmt.Printf("%s is up to date\n", *dbPath)
+		return nil
 	}
-	server := &Server{
-		DB: db,
-		apiConfig: apiCfg,
+	verb := "Applied"
+	if *dryRun {
+		verb = "Pending"
 	}
+	for _, name := range applied {
+		fmt.Printf("%s migration %s\n", verb, name)
+	}
+	return nil
+}
+
+// routes builds the handler the server serves.
+func (s *Server) routes() http.Handler {
 	r := chi.NewRouter()
 	apirouter := chi.NewRouter()
 	adminrouter := chi.NewRouter()
-	r.Mount("/api",apirouter)
-	r.Mount("/admin",adminrouter)
-	r.Handle("/app",apiCfg.hitsCounter(http.StripPrefix("/app",http.FileServer(http.Dir(".")))))
-	r.Handle("/app/*",apiCfg.hitsCounter(http.StripPrefix("/app",http.FileServer(http.Dir(".")))))
-	r.Handle("/assets/logo.png",apiCfg.hitsCounter(http.FileServer(http.Dir("./assets/logo.png"))))
-	apirouter.Get("/healthz",func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-type","text/plain; charset=utf-8")
+	r.Mount("/api", apirouter)
+	r.Get("/.well-known/jwks.json", s.getJWKS)
+	r.Mount("/admin", adminrouter)
+	r.Handle("/app", s.apiConfig.hitsCounter(http.StripPrefix("/app", http.FileServer(http.Dir(".")))))
+	r.Handle("/app/*", s.apiConfig.hitsCounter(http.StripPrefix("/app", http.FileServer(http.Dir(".")))))
+	r.Handle("/assets/logo.png", s.apiConfig.hitsCounter(http.FileServer(http.Dir("./assets/logo.png"))))
+	apirouter.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
-	adminrouter.Get("/metrics", func(w http.ResponseWriter, r *http.Request){
-		w.Header().Set("Content-type","text/html")
-		w.Write([]byte(fmt.Sprintf("<html><body><h1>Welcome, Chirpy Admin</h1><p>Chirpy has been visited %d times!</p></body></html>",apiCfg.fileserverHits)))
+	adminrouter.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-type", "text/html")
+		w.Write([]byte(fmt.Sprintf("<html><body><h1>Welcome, Chirpy Admin</h1><p>Chirpy has been visited %d times!</p></body></html>", s.apiConfig.fileserverHits)))
 	})
-	apirouter.Handle("/reset", apiCfg.resetHitsCounter())
-	corsMux := middlewareCors(r)
-	srv := &http.Server {
-		Addr: "localhost:8080",
-		Handler: corsMux,
-	}
-	apirouter.Post("/chirps",server.postChirps)
-	apirouter.Get("/chirps",server.getChirps)
-	apirouter.Get("/chirps/{id}",server.getChirp)
-	apirouter.Post("/users",server.createUser)
-	apirouter.Put("/users",server.updateUsers)
-	apirouter.Post("/login",server.userLogin)
-	apirouter.Post("/refresh",server.tokenRefresh)
-	apirouter.Post("/revoke",server.revokeToken)
-	apirouter.Delete("/chirps/{id}",server.deleteChirps)
+	apirouter.Handle("/reset", s.apiConfig.resetHitsCounter())
+	adminrouter.Group(func(r chi.Router) {
+		r.Use(s.requireAdmin)
+		r.Post("/filter/reload", s.reloadFilter)
+		r.Get("/filter/flagged", s.getFlaggedChirps)
+	})
+	// Refresh and revoke take a refresh token rather than an access token,
+	// so they authenticate themselves.
+	apirouter.Post("/users", s.createUser)
+	apirouter.Post("/login", s.userLogin)
+	apirouter.Post("/refresh", s.tokenRefresh)
+	apirouter.Post("/revoke", s.revokeToken)
+	apirouter.Group(func(r chi.Router) {
+		r.Use(s.optionalAuth)
+		r.Get("/chirps", s.getChirps)
+		r.Get("/chirps/search", s.searchChirps)
+		r.Get("/chirps/{id}", s.getChirp)
+		r.Get("/chirps/{id}/history", s.getChirpHistory)
+		r.Get("/chirps/{id}/thread", s.getThread)
+		r.Get("/users/{id}", s.getProfile)
+		r.Get("/users/{id}/followers", s.getFollowers)
+		r.Get("/users/{id}/following", s.getFollowing)
+		r.Get("/users/{id}/likes", s.getUserLikes)
+		r.Get("/users/{id}/mentions", s.getMentions)
+		r.Get("/hashtags/{tag}", s.getHashtag)
+		r.Get("/trends", s.getTrends)
+	})
+	apirouter.Group(func(r chi.Router) {
+		r.Use(s.requireAuth)
+		r.With(requireScope(scopeRead)).Get("/timeline", s.getTimeline)
+		r.Group(func(r chi.Router) {
+			r.Use(requireScope(scopeWrite))
+			r.Post("/chirps", s.postChirps)
+			r.Put("/chirps/{id}", s.updateChirp)
+			r.Delete("/chirps/{id}", s.deleteChirps)
+			r.Post("/chirps/{id}/restore", s.restoreChirp)
+			r.Post("/chirps/{id}/like", s.likeChirp)
+			r.Delete("/chirps/{id}/like", s.unlikeChirp)
+			r.Post("/chirps/{id}/rechirp", s.rechirp)
+			r.Delete("/chirps/{id}/rechirp", s.unrechirp)
+			r.Post("/users/{id}/follow", s.followUser)
+			r.Delete("/users/{id}/follow", s.unfollowUser)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(requireScope(scopeAccount))
+			r.Put("/users", s.updateUsers)
+			r.Patch("/users", s.updateUsers)
+			r.Get("/sessions", s.getSessions)
+			r.Post("/sessions/revoke-others", s.revokeOtherSessions)
+			r.Delete("/sessions/{id}", s.deleteSession)
+		})
+	})
+	return middlewareCors(r)
+}
+func main() {
+	godotenv.Load()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrateCommand(os.Args[2:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+	dbBackend := flag.String("db", "json", "storage backend: json, sqlite or memory")
+	dbPath := flag.String("dbpath", "", "path of the database file (default database.json or database.sqlite)")
+	filterConfig := flag.String("filter-config", "filter.json", "path of the content filter rules")
+	restoreWindow := flag.Duration("restore-window", 72*time.Hour, "how long deleted chirps can be restored before they are purged")
+	maxChirpLength := flag.Int("max-chirp-length", 140, "longest chirp allowed, in user-perceived characters")
+	keysPath := flag.String("keys", "keys.json", "path of the keyring tokens are signed with")
+	signingAlg := flag.String("signing-alg", keyring.EdDSA, "algorithm new signing keys use: EdDSA or RS256")
+	tokenLeeway := flag.Duration("token-leeway", 30*time.Second, "how far clocks may disagree when checking token expiry and issue times")
+	keyRotation := flag.Duration("key-rotation", 30*24*time.Hour, "how long a signing key is used before it is rotated")
+	trendWindows := flag.String("trend-windows", "1h,24h", "comma-separated windows hashtag trends are ranked over, the first being the default; chirps of the longest are counted again at startup")
+	flag.Parse()
+	if *maxChirpLength < 1 {
+		log.Fatalf("Invalid -max-chirp-length %d, expected at least 1", *maxChirpLength)
+	}
+	windows, err := parseTrendWindows(*trendWindows)
+	if err != nil {
+		log.Fatalf("Invalid -trend-windows: %v", err)
+	}
+	if os.Getenv("JWT_SECRET") != "" {
+		log.Printf("JWT_SECRET is no longer used, tokens are signed with the keys in %s", *keysPath)
+	}
+	keys, err := keyring.Load(*keysPath, *signingAlg, *keyRotation, accessTokenTTL+*tokenLeeway)
+	if err != nil {
+		log.Fatalf("Failed to load keyring: %v", err)
+	}
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" {
+		log.Printf("ADMIN_TOKEN isn't set, the admin API is disabled")
+	}
+	db, err := openStore(*dbBackend, *dbPath)
+	if err != nil {
+		log.Fatalf("Failed to connect to DB: %v", err)
+	}
+	apiCfg := apiConfig{
+		keys:           keys,
+		tokens:         tokenValidator{keys: keys, leeway: *tokenLeeway},
+		restoreWindow:  *restoreWindow,
+		maxChirpLength: *maxChirpLength,
+		adminToken:     adminToken,
+	}
+	chirpFilter, err := filter.Load(*filterConfig)
+	if err != nil {
+		log.Fatalf("Failed to load filter rules: %v", err)
+	}
+	trends := newTrendTracker(windows)
+	seeded, err := trends.seed(db, time.Now())
+	if err != nil {
+		log.Fatalf("Failed to count trending hashtags: %v", err)
+	}
+	log.Printf("Counted the hashtags of %d recent chirps for trends", seeded)
+	server := &Server{
+		DB:        db,
+		apiConfig: apiCfg,
+		filter:    chirpFilter,
+		trends:    trends,
+	}
+	srv := &http.Server{
+		Addr:    "localhost:8080",
+		Handler: server.routes(),
+	}
+	go server.purgeDeletedChirps(time.Minute)
+	go server.purgeRefreshTokens(time.Hour)
+	go server.rotateKeys(time.Minute)
 	log.Fatal(srv.ListenAndServe())
 }
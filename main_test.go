@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/tekisatsu/chirpy/internal/database"
+	"github.com/tekisatsu/chirpy/internal/filter"
+	"github.com/tekisatsu/chirpy/internal/keyring"
+)
+
+const testAdminToken = "admin-secret"
+
+// testServer serves the full router over an in-memory store.
+type testServer struct {
+	t       *testing.T
+	server  *Server
+	handler http.Handler
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+	leeway := 30 * time.Second
+	keys, err := keyring.Load(filepath.Join(dir, "keys.json"), keyring.EdDSA, 24*time.Hour, accessTokenTTL+leeway)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirpFilter, err := filter.Load(filepath.Join(dir, "filter.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	windows, err := parseTrendWindows("1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		DB: database.NewMemDb(),
+		apiConfig: apiConfig{
+			keys:           keys,
+			tokens:         tokenValidator{keys: keys, leeway: leeway},
+			restoreWindow:  time.Hour,
+			maxChirpLength: 140,
+			adminToken:     testAdminToken,
+		},
+		filter: chirpFilter,
+		trends: newTrendTracker(windows),
+	}
+	return &testServer{t: t, server: s, handler: s.routes()}
+}
+
+// do sends a request with body encoded as JSON, authorized with token when
+// it isn't empty.
+func (ts *testServer) do(method, path, token string, body any) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			ts.t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	ts.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// expect checks rec has status code and decodes its body into out, if out
+// isn't nil.
+func (ts *testServer) expect(rec *httptest.ResponseRecorder, code int, out any) {
+	ts.t.Helper()
+	if rec.Code != code {
+		ts.t.Fatalf("got status %d, want %d: %s", rec.Code, code, rec.Body.String())
+	}
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			ts.t.Fatalf("decoding %s: %v", rec.Body.String(), err)
+		}
+	}
+}
+
+type loginResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	Id           int    `json:"id"`
+	Handle       string `json:"handle"`
+}
+
+// signup creates a user and logs them in.
+func (ts *testServer) signup(email, handle string) loginResponse {
+	ts.t.Helper()
+	creds := map[string]string{"email": email, "password": "hunter22", "handle": handle}
+	ts.expect(ts.do("POST", "/api/users", "", creds), 201, nil)
+	var login loginResponse
+	ts.expect(ts.do("POST", "/api/login", "", creds), 200, &login)
+	return login
+}
+
+func (ts *testServer) postChirp(token, body string) chirpView {
+	ts.t.Helper()
+	var chirp chirpView
+	ts.expect(ts.do("POST", "/api/chirps", token, map[string]string{"body": body}), 201, &chirp)
+	return chirp
+}
+
+func TestChirpLifecycle(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com", "alice")
+
+	chirp := ts.postChirp(alice.Token, "hello #chirpy, what a kerfuffle")
+	if chirp.Body != "hello #chirpy, what a *********" {
+		t.Errorf("body = %q, want the profanity masked", chirp.Body)
+	}
+	if chirp.AuthorId != alice.Id {
+		t.Errorf("author_id = %d, want %d", chirp.AuthorId, alice.Id)
+	}
+
+	var page chirpPage
+	ts.expect(ts.do("GET", "/api/chirps", "", nil), 200, &page)
+	if len(page.Chirps) != 1 || page.Chirps[0].Id != chirp.Id {
+		t.Fatalf("GET /api/chirps = %+v, want the one chirp", page.Chirps)
+	}
+
+	rec := ts.do("PUT", "/api/chirps/1", alice.Token, map[string]string{"body": "hello again"})
+	ts.expect(rec, 200, nil)
+	expectView(t, rec)
+	var history []database.ChirpRevision
+	ts.expect(ts.do("GET", "/api/chirps/1/history", "", nil), 200, &history)
+	if len(history) != 2 || history[1].Body != "hello again" {
+		t.Errorf("history = %+v, want the original and the edit", history)
+	}
+
+	ts.expect(ts.do("DELETE", "/api/chirps/1", alice.Token, nil), 200, nil)
+	ts.expect(ts.do("GET", "/api/chirps/1", "", nil), 404, nil)
+	rec = ts.do("POST", "/api/chirps/1/restore", alice.Token, nil)
+	ts.expect(rec, 200, nil)
+	expectView(t, rec)
+	ts.expect(ts.do("GET", "/api/chirps/1", "", nil), 200, nil)
+}
+
+// expectView checks rec holds a chirp as chirpView serves it, with its
+// counts, rather than the bare stored chirp.
+func expectView(t *testing.T, rec *httptest.ResponseRecorder) {
+	t.Helper()
+	var fields map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"like_count", "rechirp_count", "quote_count", "entities"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("response has no %s: %s", key, rec.Body.String())
+		}
+	}
+}
+
+func TestChirpOwnership(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com", "alice")
+	bob := ts.signup("bob@example.com", "bob")
+	chirp := ts.postChirp(alice.Token, "mine")
+
+	path := "/api/chirps/" + strconv.Itoa(chirp.Id)
+	ts.expect(ts.do("PUT", path, bob.Token, map[string]string{"body": "yours"}), 403, nil)
+	ts.expect(ts.do("DELETE", path, bob.Token, nil), 403, nil)
+	ts.expect(ts.do("GET", path, "", nil), 200, nil)
+}
+
+func TestChirpValidation(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com", "alice")
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"at the limit", string(bytes.Repeat([]byte("a"), 140)), 201},
+		{"over the limit", string(bytes.Repeat([]byte("a"), 141)), 400},
+		{"emoji count once", string(bytes.Repeat([]byte("👍🏽"), 140)), 201},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts.expect(ts.do("POST", "/api/chirps", alice.Token, map[string]string{"body": tt.body}), tt.code, nil)
+		})
+	}
+}
+
+func TestLikes(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com", "alice")
+	chirp := ts.postChirp(alice.Token, "like me")
+	path := "/api/chirps/" + strconv.Itoa(chirp.Id)
+
+	ts.expect(ts.do("POST", path+"/like", alice.Token, nil), 200, nil)
+	var view chirpView
+	ts.expect(ts.do("GET", path, alice.Token, nil), 200, &view)
+	if view.LikeCount != 1 || view.LikedByMe == nil || !*view.LikedByMe {
+		t.Errorf("after liking: like_count %d, liked_by_me %v", view.LikeCount, view.LikedByMe)
+	}
+	view = chirpView{}
+	ts.expect(ts.do("GET", path, "", nil), 200, &view)
+	if view.LikedByMe != nil {
+		t.Errorf("anonymous view has liked_by_me %v", *view.LikedByMe)
+	}
+
+	ts.expect(ts.do("DELETE", path+"/like", alice.Token, nil), 200, nil)
+	view = chirpView{}
+	ts.expect(ts.do("GET", path, alice.Token, nil), 200, &view)
+	if view.LikeCount != 0 || *view.LikedByMe {
+		t.Errorf("after unliking: like_count %d, liked_by_me %v", view.LikeCount, *view.LikedByMe)
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	tests := []struct{ method, path string }{
+		{"POST", "/api/chirps"},
+		{"PUT", "/api/users"},
+		{"GET", "/api/timeline"},
+		{"GET", "/api/sessions"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rec := ts.do(tt.method, tt.path, "", nil)
+			ts.expect(rec, 401, nil)
+			if rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate challenge")
+			}
+			ts.expect(ts.do(tt.method, tt.path, "not-a-token", nil), 401, nil)
+		})
+	}
+}
+
+func TestRefreshRotation(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com", "alice")
+
+	var refreshed loginResponse
+	ts.expect(ts.do("POST", "/api/refresh", alice.RefreshToken, nil), 200, &refreshed)
+	if refreshed.RefreshToken == alice.RefreshToken {
+		t.Fatal("refresh didn't rotate the refresh token")
+	}
+	ts.expect(ts.do("GET", "/api/sessions", refreshed.Token, nil), 200, nil)
+
+	// Replaying the old token revokes the whole session.
+	ts.expect(ts.do("POST", "/api/refresh", alice.RefreshToken, nil), 401, nil)
+	ts.expect(ts.do("POST", "/api/refresh", refreshed.RefreshToken, nil), 401, nil)
+	ts.expect(ts.do("GET", "/api/sessions", refreshed.Token, nil), 401, nil)
+}
+
+func TestAdminAuth(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com", "alice")
+	tests := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{"no token", "", 401},
+		{"wrong token", "admin-secreT", 401},
+		{"user access token", alice.Token, 401},
+		{"admin token", testAdminToken, 204},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts.expect(ts.do("POST", "/admin/filter/reload", tt.token, nil), tt.code, nil)
+			code := tt.code
+			if code == 204 {
+				code = 200
+			}
+			ts.expect(ts.do("GET", "/admin/filter/flagged", tt.token, nil), code, nil)
+		})
+	}
+
+	ts.server.apiConfig.adminToken = ""
+	ts.expect(ts.do("POST", "/admin/filter/reload", "", nil), 401, nil)
+	ts.expect(ts.do("POST", "/admin/filter/reload", " ", nil), 401, nil)
+}
+
+func TestFlaggedChirpsAreQueued(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	config := filepath.Join(t.TempDir(), "filter.json")
+	rules := `{"normalize": {"case_fold": true}, "rules": [{"name": "giveaways", "words": ["free giveaway"], "action": "flag", "reason": "Spam"}]}`
+	if err := os.WriteFile(config, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if ts.server.filter, err = filter.Load(config); err != nil {
+		t.Fatal(err)
+	}
+	alice := ts.signup("alice@example.com", "alice")
+	chirp := ts.postChirp(alice.Token, "FREE giveaway today")
+
+	var flagged []flaggedChirp
+	ts.expect(ts.do("GET", "/admin/filter/flagged", testAdminToken, nil), 200, &flagged)
+	if len(flagged) != 1 {
+		t.Fatalf("review queue = %+v, want the one chirp", flagged)
+	}
+	got := flagged[0]
+	if got.ChirpId != chirp.Id || got.Match.Rule != "giveaways" || got.Match.Action != filter.Flag || got.Match.Start != 0 || got.Match.End != 13 {
+		t.Errorf("flagged = %+v, want chirp %d flagged by giveaways at 0-13", got, chirp.Id)
+	}
+}
+
+func TestTrendsFollowEditsAndDeletes(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com", "alice")
+	ts.postChirp(alice.Token, "learning #go")
+	ts.postChirp(alice.Token, "#go or #rust?")
+
+	counts := func() map[string]float64 {
+		t.Helper()
+		var body struct {
+			Trends []trend `json:"trends"`
+		}
+		ts.expect(ts.do("GET", "/api/trends", "", nil), 200, &body)
+		counts := map[string]float64{}
+		for _, trend := range body.Trends {
+			counts[trend.Tag] = trend.Count
+		}
+		return counts
+	}
+	steps := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		want   map[string]float64
+	}{
+		{"posted", "", "", nil, map[string]float64{"go": 2, "rust": 1}},
+		{"edited", "PUT", "/api/chirps/2", map[string]string{"body": "#zig it is"}, map[string]float64{"go": 1, "zig": 1}},
+		{"deleted", "DELETE", "/api/chirps/1", nil, map[string]float64{"zig": 1}},
+		{"restored", "POST", "/api/chirps/1/restore", nil, map[string]float64{"go": 1, "zig": 1}},
+	}
+	for _, step := range steps {
+		if step.method != "" {
+			ts.expect(ts.do(step.method, step.path, alice.Token, step.body), 200, nil)
+		}
+		got := counts()
+		if len(got) != len(step.want) {
+			t.Errorf("%s: trends = %v, want %v", step.name, got, step.want)
+			continue
+		}
+		for tag, count := range step.want {
+			if got[tag] != count {
+				t.Errorf("%s: trends = %v, want %v", step.name, got, step.want)
+				break
+			}
+		}
+	}
+}
+
+func TestDigitEmailGetsFindableHandle(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	user := ts.signup("12345@example.com", "")
+	if user.Handle != "user12345" {
+		t.Errorf("handle = %q, want user12345", user.Handle)
+	}
+	var profile database.Profile
+	ts.expect(ts.do("GET", "/api/users/"+user.Handle, "", nil), 200, &profile)
+	if profile.Id != user.Id {
+		t.Errorf("profile = %+v, want user %d", profile, user.Id)
+	}
+	creds := map[string]string{"email": "bob@example.com", "password": "hunter22", "handle": "12345"}
+	ts.expect(ts.do("POST", "/api/users", "", creds), 400, nil)
+}
+
+func TestCorsPreflight(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	rec := ts.do("OPTIONS", "/api/users/me", "", nil)
+	ts.expect(rec, 200, nil)
+	allowed := map[string]bool{}
+	for _, method := range strings.Split(rec.Header().Get("Access-Control-Allow-Methods"), ",") {
+		allowed[strings.TrimSpace(method)] = true
+	}
+	for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE"} {
+		if !allowed[method] {
+			t.Errorf("preflight doesn't allow %s", method)
+		}
+	}
+}
+
+func TestOptionalAuthServesBadTokensAnonymously(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com", "alice")
+	chirp := ts.postChirp(alice.Token, "hello")
+	ts.expect(ts.do("POST", "/api/chirps/1/like", alice.Token, nil), 200, nil)
+	ts.expect(ts.do("POST", "/api/revoke", alice.RefreshToken, nil), 200, nil)
+
+	for name, token := range map[string]string{
+		"logged out": alice.Token,
+		"garbled":    "not-a-token",
+	} {
+		t.Run(name, func(t *testing.T) {
+			var page chirpPage
+			ts.expect(ts.do("GET", "/api/chirps", token, nil), 200, &page)
+			if len(page.Chirps) != 1 || page.Chirps[0].Id != chirp.Id {
+				t.Fatalf("chirps = %+v, want the one chirp", page.Chirps)
+			}
+			if page.Chirps[0].LikedByMe != nil {
+				t.Errorf("liked_by_me = %v, want it left out for an anonymous view", *page.Chirps[0].LikedByMe)
+			}
+			ts.expect(ts.do("DELETE", "/api/chirps/1/like", token, nil), 401, nil)
+		})
+	}
+}
+
+func TestHandlerWithoutRequireAuth(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	rec := httptest.NewRecorder()
+	ts.server.postChirps(rec, httptest.NewRequest("POST", "/api/chirps", strings.NewReader(`{"body": "hello"}`)))
+	if rec.Code != 500 {
+		t.Errorf("got status %d, want 500", rec.Code)
+	}
+}
+
+func TestScopes(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com", "alice")
+	login := &accessClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(alice.Token, login); err != nil {
+		t.Fatal(err)
+	}
+	if login.Scope != "read write account" {
+		t.Errorf("login token scope = %q, want every scope", login.Scope)
+	}
+	readOnly := *login
+	readOnly.Scope = scopeRead
+	token, err := ts.server.apiConfig.keys.Sign(&readOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.expect(ts.do("GET", "/api/timeline", token, nil), 200, nil)
+	for _, tt := range []struct{ method, path, scope string }{
+		{"POST", "/api/chirps", scopeWrite},
+		{"POST", "/api/users/1/follow", scopeWrite},
+		{"GET", "/api/sessions", scopeAccount},
+		{"PATCH", "/api/users", scopeAccount},
+	} {
+		rec := ts.do(tt.method, tt.path, token, map[string]string{"body": "hello"})
+		ts.expect(rec, 403, nil)
+		want := fmt.Sprintf(`Bearer realm="chirpy", error="insufficient_scope", scope=%q`, tt.scope)
+		if got := rec.Header().Get("WWW-Authenticate"); got != want {
+			t.Errorf("%s %s challenge = %s, want %s", tt.method, tt.path, got, want)
+		}
+	}
+}
+
+func TestThreadNotFound(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com", "alice")
+	ts.postChirp(alice.Token, "soon gone")
+	ts.expect(ts.do("DELETE", "/api/chirps/1", alice.Token, nil), 200, nil)
+	for _, path := range []string{"/api/chirps/1/thread", "/api/chirps/99/thread"} {
+		ts.expect(ts.do("GET", path, "", nil), 404, nil)
+	}
+}
+
+func TestChirpLengthAfterMasking(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "filter.json")
+	config := `{"rules": [{"name": "pins", "words": ["pin"], "action": "mask", "replacement": "[redacted]"}]}`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	chirpFilter, err := filter.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.server.filter = chirpFilter
+	alice := ts.signup("alice@example.com", "alice")
+
+	long := "pin " + strings.Repeat("a", 136)
+	ts.expect(ts.do("POST", "/api/chirps", alice.Token, map[string]string{"body": long}), 400, nil)
+	ts.postChirp(alice.Token, "short")
+	ts.expect(ts.do("PUT", "/api/chirps/1", alice.Token, map[string]string{"body": long}), 400, nil)
+	ts.postChirp(alice.Token, "pin "+strings.Repeat("a", 129))
+}
+
+func TestChirpPages(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com", "alice")
+	for i := 1; i <= 5; i++ {
+		ts.postChirp(alice.Token, fmt.Sprint("chirp ", i))
+	}
+
+	for _, query := range []string{
+		"limit=0",
+		"limit=-1",
+		"limit=201",
+		"limit=ten",
+		"sort=newest",
+		"since=yesterday",
+		"until=2024-01-01",
+		"author_id=alice",
+		"cursor=!!",
+		"cursor=" + base64.RawURLEncoding.EncodeToString([]byte("x")),
+	} {
+		rec := ts.do("GET", "/api/chirps?"+query, "", nil)
+		if rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+	ts.expect(ts.do("GET", "/api/chirps?limit=200", "", nil), 200, nil)
+
+	// next is only set when another page follows, and following it picks
+	// up where the page ended.
+	var got []int
+	path := "/api/chirps?sort=desc&limit=2"
+	for pages := 0; path != ""; pages++ {
+		if pages == 3 {
+			t.Fatal("more pages than chirps")
+		}
+		var page chirpPage
+		ts.expect(ts.do("GET", path, "", nil), 200, &page)
+		for _, chirp := range page.Chirps {
+			got = append(got, chirp.Id)
+		}
+		path = ""
+		if page.Next != "" {
+			path = "/api/chirps?sort=desc&limit=2&cursor=" + page.Next
+		}
+	}
+	if fmt.Sprint(got) != "[5 4 3 2 1]" {
+		t.Errorf("paged through %v, want [5 4 3 2 1]", got)
+	}
+}
+
+func TestFollowRoutes(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com", "alice")
+	bob := ts.signup("bob@example.com", "bob")
+	ts.postChirp(bob.Token, "from bob")
+	ts.postChirp(alice.Token, "from alice")
+
+	follow := fmt.Sprintf("/api/users/%d/follow", bob.Id)
+	ts.expect(ts.do("POST", fmt.Sprintf("/api/users/%d/follow", alice.Id), alice.Token, nil), 400, nil)
+	ts.expect(ts.do("POST", "/api/users/99/follow", alice.Token, nil), 404, nil)
+	ts.expect(ts.do("POST", "/api/users/bob/follow", alice.Token, nil), 400, nil)
+	ts.expect(ts.do("POST", follow, alice.Token, nil), 200, nil)
+	ts.expect(ts.do("POST", follow, alice.Token, nil), 200, nil)
+
+	var followers []database.Follow
+	ts.expect(ts.do("GET", fmt.Sprintf("/api/users/%d/followers", bob.Id), "", nil), 200, &followers)
+	if len(followers) != 1 || followers[0].UserId != alice.Id {
+		t.Errorf("bob's followers = %+v, want alice once", followers)
+	}
+	var page chirpPage
+	ts.expect(ts.do("GET", "/api/timeline", alice.Token, nil), 200, &page)
+	if len(page.Chirps) != 1 || page.Chirps[0].Id != 1 {
+		t.Errorf("timeline = %+v, want bob's chirp only", page.Chirps)
+	}
+
+	ts.expect(ts.do("DELETE", follow, alice.Token, nil), 200, nil)
+	ts.expect(ts.do("DELETE", follow, alice.Token, nil), 200, nil)
+	ts.expect(ts.do("GET", "/api/timeline", alice.Token, nil), 200, &page)
+	if len(page.Chirps) != 0 {
+		t.Errorf("timeline after unfollowing = %+v, want it empty", page.Chirps)
+	}
+}
+
+func TestRechirpsAndQuotes(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com", "alice")
+	bob := ts.signup("bob@example.com", "bob")
+	original := ts.postChirp(alice.Token, "soon to be gone")
+	path := "/api/chirps/" + strconv.Itoa(original.Id)
+
+	var rechirp chirpView
+	ts.expect(ts.do("POST", path+"/rechirp", bob.Token, nil), 201, &rechirp)
+	if rechirp.Original == nil || rechirp.Original.Id != original.Id || rechirp.Original.Chirp == nil {
+		t.Errorf("rechirp = %+v, want it to carry chirp %d", rechirp, original.Id)
+	}
+	ts.expect(ts.do("POST", path+"/rechirp", bob.Token, nil), 409, nil)
+	ts.expect(ts.do("POST", "/api/chirps/99/rechirp", bob.Token, nil), 404, nil)
+	var quote chirpView
+	ts.expect(ts.do("POST", "/api/chirps", bob.Token, map[string]any{"body": "quoting", "quote_of": original.Id}), 201, &quote)
+	ts.expect(ts.do("POST", "/api/chirps", bob.Token, map[string]any{"body": "quoting", "quote_of": 99}), 400, nil)
+
+	var view chirpView
+	ts.expect(ts.do("GET", path, "", nil), 200, &view)
+	if view.RechirpCount != 1 || view.QuoteCount != 1 {
+		t.Errorf("counts = %d rechirps, %d quotes, want 1 and 1", view.RechirpCount, view.QuoteCount)
+	}
+
+	// Once the original is deleted, and again once it is purged, the quote
+	// and rechirp still load but show only that it's unavailable.
+	ts.expect(ts.do("DELETE", path, alice.Token, nil), 200, nil)
+	ts.expect(ts.do("POST", path+"/rechirp", bob.Token, nil), 404, nil)
+	for _, step := range []string{"deleted", "purged"} {
+		if step == "purged" {
+			if _, err := ts.server.DB.PurgeChirps(time.Now().Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, id := range []int{quote.Id, rechirp.Id} {
+			rec := ts.do("GET", "/api/chirps/"+strconv.Itoa(id), "", nil)
+			var view chirpView
+			ts.expect(rec, 200, &view)
+			if view.Original == nil || !view.Original.Unavailable || view.Original.Id != original.Id {
+				t.Errorf("%s: chirp %d has original %+v, want it unavailable", step, id, view.Original)
+			}
+			if strings.Contains(rec.Body.String(), original.Body) {
+				t.Errorf("%s: chirp %d leaks the original: %s", step, id, rec.Body.String())
+			}
+		}
+	}
+}
+
+func TestSessionRoutes(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	phone := ts.signup("alice@example.com", "alice")
+	var laptop loginResponse
+	creds := map[string]string{"email": "alice@example.com", "password": "hunter22"}
+	ts.expect(ts.do("POST", "/api/login", "", creds), 200, &laptop)
+	bob := ts.signup("bob@example.com", "bob")
+
+	// sessions lists the caller's sessions and returns the one token is for.
+	sessions := func(token string, want int) (current string) {
+		t.Helper()
+		var list []sessionResponse
+		ts.expect(ts.do("GET", "/api/sessions", token, nil), 200, &list)
+		if len(list) != want {
+			t.Fatalf("listed %d sessions, want %d: %+v", len(list), want, list)
+		}
+		for _, session := range list {
+			if session.Current {
+				if current != "" {
+					t.Errorf("more than one current session: %+v", list)
+				}
+				current = session.Id
+			}
+		}
+		if current == "" {
+			t.Errorf("no current session: %+v", list)
+		}
+		return current
+	}
+	phoneSession := sessions(phone.Token, 2)
+	laptopSession := sessions(laptop.Token, 2)
+	bobSession := sessions(bob.Token, 1)
+	if phoneSession == laptopSession {
+		t.Fatalf("both logins share session %s", phoneSession)
+	}
+
+	ts.expect(ts.do("DELETE", "/api/sessions/"+phoneSession, bob.Token, nil), 404, nil)
+	ts.expect(ts.do("DELETE", "/api/sessions/no-such-session", bob.Token, nil), 404, nil)
+	ts.expect(ts.do("DELETE", "/api/sessions/"+bobSession, phone.Token, nil), 404, nil)
+	sessions(phone.Token, 2)
+
+	// Logging the phone out from itself ends its access token at once, and
+	// its refresh token with it.
+	ts.expect(ts.do("DELETE", "/api/sessions/"+phoneSession, phone.Token, nil), 204, nil)
+	ts.expect(ts.do("GET", "/api/sessions", phone.Token, nil), 401, nil)
+	ts.expect(ts.do("POST", "/api/refresh", phone.RefreshToken, nil), 401, nil)
+	sessions(laptop.Token, 1)
+	sessions(bob.Token, 1)
+}
+
+func TestTrendsSeededAtStartup(t *testing.T) {
+	t.Parallel()
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com", "alice")
+	// More chirps than fit on a page, so seeding has to page through them.
+	for i := 0; i < maxChirpPageSize; i++ {
+		if _, err := ts.server.DB.CreateChirp("#go again", alice.Id, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts.postChirp(alice.Token, "#rust once")
+	deleted := ts.postChirp(alice.Token, "#zig gone")
+	ts.expect(ts.do("DELETE", "/api/chirps/"+strconv.Itoa(deleted.Id), alice.Token, nil), 200, nil)
+
+	restarted := newTrendTracker(ts.server.trends.windows)
+	now := time.Now()
+	seeded, err := restarted.seed(ts.server.DB, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seeded != maxChirpPageSize+1 {
+		t.Errorf("seeded %d chirps, want %d", seeded, maxChirpPageSize+1)
+	}
+	got := restarted.top(0, maxTrendLimit, now)
+	if len(got) != 2 || got[0].Tag != "go" || got[0].Count != maxChirpPageSize || got[1].Tag != "rust" || got[1].Count != 1 {
+		t.Errorf("trends after seeding = %+v, want go %d times and rust once", got, maxChirpPageSize)
+	}
+}
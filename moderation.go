@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/tekisatsu/chirpy/internal/database"
+	"github.com/tekisatsu/chirpy/internal/filter"
+)
+
+// reviewQueueSize is how many of the most recent flags the review queue
+// shows.
+const reviewQueueSize = 1000
+
+// flaggedChirp is a chirp a filter rule let through but flagged for
+// review.
+type flaggedChirp struct {
+	ChirpId   int          `json:"chirp_id"`
+	Match     filter.Match `json:"match"`
+	FlaggedAt time.Time    `json:"flagged_at"`
+}
+
+// flagChirp puts a chirp the filter flagged in the review queue. The chirp
+// is already stored, so failing to flag it is logged rather than failing
+// the request.
+func (s *Server) flagChirp(chirpId int, matches []filter.Match) {
+	if len(matches) == 0 {
+		return
+	}
+	flags := make([]database.Flag, len(matches))
+	for i, match := range matches {
+		log.Printf("Chirp %d flagged for review by filter rule %q", chirpId, match.Rule)
+		flags[i] = database.Flag{Rule: match.Rule, Reason: match.Reason, Start: match.Start, End: match.End}
+	}
+	if err := s.DB.FlagChirp(chirpId, flags); err != nil {
+		log.Printf("Error flagging Chirp %d for review: %v", chirpId, err)
+	}
+}
+
+// filterChirp runs a chirp body through the content filter. When a rule
+// rejects it, it writes the 400 and reports false.
+func (s *Server) filterChirp(w http.ResponseWriter, body string) (filter.Result, bool) {
+	result := s.filter.Apply(body)
+	if result.Rejected != nil {
+		reason := result.Rejected.Reason
+		if reason == "" {
+			reason = "Chirp rejected by the content filter"
+		}
+		respondWithJSON(w, 400, struct {
+			Error string `json:"error"`
+			Rule  string `json:"rule"`
+		}{Error: reason, Rule: result.Rejected.Rule})
+		return result, false
+	}
+	return result, true
+}
+func (s *Server) reloadFilter(w http.ResponseWriter, r *http.Request) {
+	if err := s.filter.Reload(); err != nil {
+		log.Printf("Error reloading filter: %v", err)
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	log.Printf("Reloaded filter rules")
+	w.WriteHeader(204)
+}
+func (s *Server) getFlaggedChirps(w http.ResponseWriter, r *http.Request) {
+	flags, err := s.DB.GetFlags(reviewQueueSize)
+	if err != nil {
+		log.Printf("Error listing flagged Chirps: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	flagged := make([]flaggedChirp, len(flags))
+	for i, flag := range flags {
+		flagged[i] = flaggedChirp{
+			ChirpId:   flag.ChirpId,
+			Match:     filter.Match{Rule: flag.Rule, Action: filter.Flag, Reason: flag.Reason, Start: flag.Start, End: flag.End},
+			FlaggedAt: flag.FlaggedAt,
+		}
+	}
+	respondWithJSON(w, 200, flagged)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tekisatsu/chirpy/internal/database"
+)
+
+// isInvalidUpdate reports the errors of a user update that mean the
+// request itself was bad.
+func isInvalidUpdate(err error) bool {
+	return errors.Is(err, database.ErrInvalidEmail) ||
+		errors.Is(err, database.ErrInvalidPassword) ||
+		errors.Is(err, database.ErrInvalidHandle) ||
+		errors.Is(err, database.ErrInvalidDisplayName) ||
+		errors.Is(err, database.ErrInvalidBio) ||
+		errors.Is(err, database.ErrInvalidAvatar)
+}
+
+// getProfile shows the public profile of a user, named by id or by
+// handle with or without the @.
+func (s *Server) getProfile(w http.ResponseWriter, r *http.Request) {
+	ref := chi.URLParam(r, "id")
+	userId, err := strconv.Atoi(ref)
+	if err != nil {
+		var user database.UserResponse
+		user, err = s.DB.GetUserByHandle(strings.TrimPrefix(ref, "@"))
+		userId = user.Id
+	}
+	var profile database.Profile
+	if err == nil {
+		profile, err = s.DB.GetProfile(userId)
+	}
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting profile: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	respondWithJSON(w, 200, profile)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tekisatsu/chirpy/internal/database"
+)
+
+// rechirp reposts a chirp as the caller. Rechirping a rechirp reposts the
+// chirp it points at.
+func (s *Server) rechirp(w http.ResponseWriter, r *http.Request) {
+	current, ok := currentUser(r)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+	userId := current.UserId
+	chirpId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid chirp id")
+		return
+	}
+	chirp, err := s.DB.Rechirp(chirpId, userId)
+	switch {
+	case errors.Is(err, database.ErrOriginalNotFound):
+		w.WriteHeader(404)
+		return
+	case errors.Is(err, database.ErrAlreadyRechirped):
+		respondWithError(w, 409, err.Error())
+		return
+	case err != nil:
+		log.Printf("Error rechirping: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	views, err := s.viewChirps(r, []database.Chirp{chirp})
+	if err != nil {
+		log.Printf("Error viewing rechirp: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	respondWithJSON(w, 201, views[0])
+}
+
+// unrechirp deletes the caller's rechirp of a chirp, if there is one.
+func (s *Server) unrechirp(w http.ResponseWriter, r *http.Request) {
+	current, ok := currentUser(r)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+	userId := current.UserId
+	chirpId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "Invalid chirp id")
+		return
+	}
+	err = s.DB.Unrechirp(chirpId, userId)
+	if errors.Is(err, database.ErrOriginalNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Printf("Error removing rechirp: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
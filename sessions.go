@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tekisatsu/chirpy/internal/database"
+)
+
+// clientOf is where r came from, as recorded on sessions. Chirpy listens
+// directly, so the peer address is the client's.
+func clientOf(r *http.Request) database.Client {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return database.Client{IP: ip, UserAgent: r.UserAgent()}
+}
+
+type sessionResponse struct {
+	database.Session
+	Current bool `json:"current"`
+}
+
+func (s *Server) getSessions(w http.ResponseWriter, r *http.Request) {
+	current, ok := currentUser(r)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+	sessions, err := s.DB.ListSessions(current.UserId)
+	if err != nil {
+		log.Printf("Error listing sessions: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	resp := make([]sessionResponse, len(sessions))
+	for i, session := range sessions {
+		resp[i] = sessionResponse{Session: session, Current: session.Id == current.SessionId}
+	}
+	respondWithJSON(w, 200, resp)
+}
+
+// deleteSession logs a session of the caller out, which may be the one
+// making the request.
+func (s *Server) deleteSession(w http.ResponseWriter, r *http.Request) {
+	current, ok := currentUser(r)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+	err := s.DB.RevokeSession(current.UserId, chi.URLParam(r, "id"))
+	if errors.Is(err, database.ErrSessionNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Printf("Error revoking session: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// revokeOtherSessions logs the caller out everywhere but the session
+// making the request.
+func (s *Server) revokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	current, ok := currentUser(r)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+	n, err := s.DB.RevokeOtherSessions(current.UserId, current.SessionId)
+	if err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	respondWithJSON(w, 200, struct {
+		Revoked int `json:"revoked"`
+	}{n})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tekisatsu/chirpy/internal/database"
+)
+
+const (
+	// trendBaseline is how many windows the baseline a tag is measured
+	// against looks back, so the hourly window compares with the last day.
+	trendBaseline = 24
+	// Tags whose baseline has decayed below trendForget are dropped, on
+	// every read and every trendPruneEvery chirps.
+	trendForget       = 0.01
+	trendPruneEvery   = 1000
+	defaultTrendLimit = 10
+	maxTrendLimit     = 50
+)
+
+// trendWindow is one window trends can be ranked over, e.g. "1h".
+type trendWindow struct {
+	label    string
+	duration time.Duration
+}
+
+func parseTrendWindows(list string) ([]trendWindow, error) {
+	var windows []trendWindow
+	for _, label := range strings.Split(list, ",") {
+		label = strings.TrimSpace(label)
+		d, err := time.ParseDuration(label)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("Invalid trend window %q", label)
+		}
+		windows = append(windows, trendWindow{label: label, duration: d})
+	}
+	return windows, nil
+}
+
+// decayed is a count that halves every halfLife. A tag used at a steady
+// rate settles at rate*halfLife/ln 2, so two of them with different half
+// lives compare like for like once scaled by the ratio of their half lives.
+type decayed struct {
+	value float64
+	at    time.Time
+}
+
+func (d decayed) valueAt(now time.Time, halfLife time.Duration) float64 {
+	return d.value * decay(now.Sub(d.at), halfLife)
+}
+func (d *decayed) add(now time.Time, halfLife time.Duration, n float64) {
+	d.value = max(d.valueAt(now, halfLife)+n, 0)
+	d.at = now
+}
+func decay(age, halfLife time.Duration) float64 {
+	return math.Exp2(-float64(age) / float64(halfLife))
+}
+
+// tagTrend keeps, per window, a fast count with the window as half life
+// and a slow baseline over trendBaseline windows.
+type tagTrend struct {
+	tag        string
+	fast, slow []decayed
+}
+
+// trendTracker ranks hashtags by how much more they are used now than
+// their baseline, so a tag that is always busy doesn't trend and a tag
+// that suddenly takes off does. It is fed each chirp as it is posted,
+// edited, deleted or restored and lives in memory, so the server seeds it
+// at startup from the chirps of the longest window.
+type trendTracker struct {
+	mux     sync.Mutex
+	windows []trendWindow
+	tags    map[string]*tagTrend
+	added   int
+}
+
+func newTrendTracker(windows []trendWindow) *trendTracker {
+	return &trendTracker{windows: windows, tags: map[string]*tagTrend{}}
+}
+
+// seed counts the chirps posted within the longest window, as if the
+// tracker had been running while they were. Baselines only reach back as
+// far, so right after a restart they are lower than they would otherwise
+// be.
+func (t *trendTracker) seed(db database.Store, now time.Time) (int, error) {
+	var longest time.Duration
+	for _, w := range t.windows {
+		longest = max(longest, w.duration)
+	}
+	q := database.ChirpQuery{Since: now.Add(-longest), Limit: maxChirpPageSize}
+	seeded := 0
+	for {
+		chirps, err := db.GetChirps(q)
+		if err != nil {
+			return seeded, err
+		}
+		for _, chirp := range chirps {
+			t.add(chirp, now)
+		}
+		seeded += len(chirps)
+		if len(chirps) < q.Limit {
+			return seeded, nil
+		}
+		q.After = chirps[len(chirps)-1].Id
+	}
+}
+
+// add counts each distinct hashtag of a chirp once, as of when the chirp
+// was posted, so re-adding an edited or restored chirp doesn't make its
+// tags look fresh.
+func (t *trendTracker) add(chirp database.Chirp, now time.Time) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.added++; t.added%trendPruneEvery == 0 {
+		t.prune(now)
+	}
+	t.count(chirp, 1, now)
+}
+
+// remove takes back what add counted for a chirp that is deleted or about
+// to be edited.
+func (t *trendTracker) remove(chirp database.Chirp, now time.Time) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.count(chirp, -1, now)
+}
+
+// count adds n for each distinct hashtag of chirp, decayed by the chirp's
+// age. Removing a tag that was already forgotten does nothing.
+func (t *trendTracker) count(chirp database.Chirp, n float64, now time.Time) {
+	age := now.Sub(chirp.CreatedAt)
+	if chirp.CreatedAt.IsZero() || age < 0 {
+		age = 0
+	}
+	seen := map[string]bool{}
+	for _, hashtag := range chirp.Entities.Hashtags {
+		key := database.HashtagKey(hashtag.Tag)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		trend, ok := t.tags[key]
+		if !ok {
+			if n < 0 {
+				continue
+			}
+			trend = &tagTrend{fast: make([]decayed, len(t.windows)), slow: make([]decayed, len(t.windows))}
+			t.tags[key] = trend
+		}
+		if n > 0 {
+			trend.tag = hashtag.Tag
+		}
+		for i, w := range t.windows {
+			trend.fast[i].add(now, w.duration, n*decay(age, w.duration))
+			trend.slow[i].add(now, trendBaseline*w.duration, n*decay(age, trendBaseline*w.duration))
+		}
+	}
+}
+
+type trend struct {
+	Tag string `json:"tag"`
+	// Count is the decayed number of chirps using the tag in the window.
+	Count float64 `json:"count"`
+	// Score is how far Count is above what the baseline predicts.
+	Score float64 `json:"score"`
+}
+
+// prune forgets tags that haven't been used for long enough that no
+// window remembers them.
+func (t *trendTracker) prune(now time.Time) {
+	for key, tt := range t.tags {
+		forgotten := true
+		for i, w := range t.windows {
+			if tt.slow[i].valueAt(now, trendBaseline*w.duration) >= trendForget {
+				forgotten = false
+			}
+		}
+		if forgotten {
+			delete(t.tags, key)
+		}
+	}
+}
+
+// top ranks the tags trending in window i.
+func (t *trendTracker) top(i, limit int, now time.Time) []trend {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.prune(now)
+	w := t.windows[i].duration
+	trends := []trend{}
+	for _, tt := range t.tags {
+		count := tt.fast[i].valueAt(now, w)
+		score := count - tt.slow[i].valueAt(now, trendBaseline*w)/trendBaseline
+		if score <= 0 {
+			continue
+		}
+		trends = append(trends, trend{Tag: tt.tag, Count: round2(count), Score: round2(score)})
+	}
+	sort.Slice(trends, func(a, b int) bool {
+		if trends[a].Score != trends[b].Score {
+			return trends[a].Score > trends[b].Score
+		}
+		return trends[a].Tag < trends[b].Tag
+	})
+	if len(trends) > limit {
+		trends = trends[:limit]
+	}
+	return trends
+}
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+// getTrends ranks hashtags over the window named by ?window=, the first
+// configured one by default.
+func (s *Server) getTrends(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	window := 0
+	if v := query.Get("window"); v != "" {
+		window = -1
+		d, err := time.ParseDuration(v)
+		for i, tw := range s.trends.windows {
+			if tw.label == v || err == nil && tw.duration == d {
+				window = i
+			}
+		}
+		if window < 0 {
+			labels := make([]string, len(s.trends.windows))
+			for i, tw := range s.trends.windows {
+				labels[i] = tw.label
+			}
+			respondWithError(w, 400, fmt.Sprintf("Invalid window %q, expected one of %s", v, strings.Join(labels, ", ")))
+			return
+		}
+	}
+	limit := defaultTrendLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxTrendLimit {
+			respondWithError(w, 400, fmt.Sprintf("Invalid limit %q, expected 1 to %d", v, maxTrendLimit))
+			return
+		}
+	}
+	respondWithJSON(w, 200, struct {
+		Window string  `json:"window"`
+		Trends []trend `json:"trends"`
+	}{s.trends.windows[window].label, s.trends.top(window, limit, time.Now())})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/tekisatsu/chirpy/internal/database"
+)
+
+// chirpView is a chirp as served to clients, with its like, rechirp and
+// quote counts and, when the request carries a valid access token, whether
+// the caller likes it. Rechirps and quotes also carry the chirp they
+// amplify.
+type chirpView struct {
+	database.Chirp
+	LikeCount    int            `json:"like_count"`
+	LikedByMe    *bool          `json:"liked_by_me,omitempty"`
+	RechirpCount int            `json:"rechirp_count"`
+	QuoteCount   int            `json:"quote_count"`
+	Original     *originalChirp `json:"original,omitempty"`
+}
+
+// originalChirp is the chirp a rechirp or quote points at, or just its id
+// and unavailable once it has been deleted.
+type originalChirp struct {
+	*database.Chirp
+	Id          int  `json:"id"`
+	Unavailable bool `json:"unavailable,omitempty"`
+}
+
+func (s *Server) viewChirps(r *http.Request, chirps []database.Chirp) ([]chirpView, error) {
+	viewerId := 0
+	if p, ok := principalFrom(r.Context()); ok {
+		viewerId = p.UserId
+	}
+	ids := make([]int, len(chirps))
+	for i, chirp := range chirps {
+		ids[i] = chirp.Id
+	}
+	stats, err := s.DB.ChirpStats(ids, viewerId)
+	if err != nil {
+		return nil, err
+	}
+	originals := map[int]*originalChirp{}
+	views := make([]chirpView, len(chirps))
+	for i, chirp := range chirps {
+		views[i] = chirpView{
+			Chirp:        chirp,
+			LikeCount:    stats[chirp.Id].Likes,
+			RechirpCount: stats[chirp.Id].Rechirps,
+			QuoteCount:   stats[chirp.Id].Quotes,
+		}
+		if viewerId != 0 {
+			liked := stats[chirp.Id].Liked
+			views[i].LikedByMe = &liked
+		}
+		originalId := chirp.RechirpOf
+		if originalId == nil {
+			originalId = chirp.QuoteOf
+		}
+		if originalId == nil {
+			continue
+		}
+		if originals[*originalId] == nil {
+			original, err := s.DB.GetChirp(*originalId)
+			switch {
+			case errors.Is(err, database.ErrChirpNotFound):
+				originals[*originalId] = &originalChirp{Id: *originalId, Unavailable: true}
+			case err != nil:
+				return nil, err
+			default:
+				originals[*originalId] = &originalChirp{Chirp: &original, Id: original.Id}
+			}
+		}
+		views[i].Original = originals[*originalId]
+	}
+	return views, nil
+}